@@ -0,0 +1,226 @@
+package acmeproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockedOut sends 429 Too Many Requests and returns true when the client
+// IP or the username it tries is banned
+func lockedOut(w http.ResponseWriter, r *http.Request, config *Config, username string, hasUsername bool) bool {
+	checks := []struct{ kind, name string }{{BanIP, clientIP(r)}}
+	if hasUsername && len(username) > 0 {
+		checks = append(checks, struct{ kind, name string }{BanUser, username})
+	}
+
+	for _, check := range checks {
+		ban, err := config.Lockout.Banned(check.kind, check.name)
+		if err != nil {
+			// Don't lock everybody out when the state store fails
+			log.WithField("error", err.Error()).Error("Unable to check bans")
+			continue
+		}
+		if ban == nil {
+			continue
+		}
+
+		retryAfter := int(time.Until(ban.Until).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, http.StatusTooManyRequests, CodeTooManyAttempts, "Too many failed authentication attempts", map[string]interface{}{"until": ban.Until})
+		log.WithFields(log.Fields{
+			"prefix":   "lockout: " + clientIP(r),
+			check.kind: check.name,
+			"until":    ban.Until,
+		}).Warning("Request refused, banned")
+		return true
+	}
+	return false
+}
+
+// recordFailure counts a failed authentication attempt for the client IP
+// and the username, and bans them when they cross the threshold
+func recordFailure(r *http.Request, config *Config, username string) {
+	checks := []struct{ kind, name string }{{BanIP, clientIP(r)}}
+	if len(username) > 0 {
+		checks = append(checks, struct{ kind, name string }{BanUser, username})
+	}
+
+	for _, check := range checks {
+		ban, err := config.Lockout.Fail(check.kind, check.name)
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Unable to record failed authentication attempt")
+			continue
+		}
+		if ban != nil {
+			audit(r, config, "auth-ban", log.Fields{
+				check.kind: check.name,
+				"until":    ban.Until,
+				"failures": ban.Failures,
+			})
+		}
+	}
+}
+
+// adminHandler only lets admins (see admin-users) through to h
+func adminHandler(h http.Handler, action string, a AuthenticatorInterface, config *Config) http.Handler {
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestIdentity(r, config)
+		if !id.Admin {
+			writeError(w, r, http.StatusForbidden, CodeForbidden, "Admin role required", nil)
+			audit(r, config, "admin-denied", log.Fields{
+				"owner": id.Owner(),
+				"path":  r.URL.Path,
+			})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+	if a == nil && config.JWT == nil && config.HMAC == nil && config.SSH == nil {
+		return admin
+	}
+	return AuthenticationHandler(admin, action, a, config)
+}
+
+// BansHandler lists the current bans (GET) or lifts the ban on an IP or
+// user (DELETE with ?ip= or ?user=)
+func BansHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.Lockout == nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Lockout is disabled", nil)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			bans, err := config.Lockout.Bans()
+			if err != nil {
+				log.WithField("error", err.Error()).Error("Unable to list bans")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to list bans", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(bans)
+		case http.MethodDelete:
+			kind, name := BanIP, r.URL.Query().Get(BanIP)
+			if len(name) == 0 {
+				kind, name = BanUser, r.URL.Query().Get(BanUser)
+			}
+			if len(name) == 0 {
+				writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Specify the ip or user to clear", nil)
+				return
+			}
+			if err := config.Lockout.Clear(kind, name); err != nil {
+				log.WithField("error", err.Error()).Error("Unable to clear ban")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to clear ban", nil)
+				return
+			}
+			audit(r, config, "ban-cleared", log.Fields{
+				kind:    name,
+				"owner": requestIdentity(r, config).Owner(),
+			})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), nil)
+		}
+	})
+}
+
+// ApprovalsHandler lists the pending requests and approved domains (GET),
+// approves a domain (POST with ?domain= and optionally ?ttl=<seconds>) or
+// rejects or revokes it (DELETE with ?domain=)
+func ApprovalsHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.Approvals == nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Approval is disabled", nil)
+			return
+		}
+
+		domain := r.URL.Query().Get("domain")
+		if r.Method != http.MethodGet && len(domain) == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Specify the domain", nil)
+			return
+		}
+		owner := requestIdentity(r, config).Owner()
+
+		switch r.Method {
+		case http.MethodGet:
+			pending, approved, err := config.Approvals.List()
+			if err != nil {
+				log.WithField("error", err.Error()).Error("Unable to list approvals")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to list approvals", nil)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"pending":  pending,
+				"approved": approved,
+			})
+		case http.MethodPost:
+			ttl := config.Approvals.TTL
+			if s := r.URL.Query().Get("ttl"); len(s) > 0 {
+				seconds, err := strconv.Atoi(s)
+				if err != nil || seconds < 0 {
+					writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Invalid ttl", nil)
+					return
+				}
+				ttl = time.Duration(seconds) * time.Second
+			}
+			approval, err := config.Approvals.Approve(domain, owner, ttl)
+			if err != nil {
+				log.WithField("error", err.Error()).Error("Unable to approve domain")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to approve domain", nil)
+				return
+			}
+			audit(r, config, "approval-granted", log.Fields{
+				"domain": approval.Domain,
+				"owner":  owner,
+				"ttl":    ttl.String(),
+			})
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(approval)
+		case http.MethodDelete:
+			if err := config.Approvals.Remove(domain); err != nil {
+				log.WithField("error", err.Error()).Error("Unable to remove approval")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to remove approval", nil)
+				return
+			}
+			audit(r, config, "approval-removed", log.Fields{
+				"domain": domain,
+				"owner":  owner,
+			})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), nil)
+		}
+	})
+}
+
+// QuotasHandler lists the use of the quotas in their current windows
+func QuotasHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.Quotas == nil {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "Quotas are disabled", nil)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), nil)
+			return
+		}
+
+		usage, err := config.Quotas.Usage()
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Unable to list quota usage")
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to list quota usage", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	})
+}
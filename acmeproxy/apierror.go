@@ -0,0 +1,93 @@
+package acmeproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// APIPrefix is the path prefix of the versioned API. Its errors are JSON,
+// the unversioned routes keep sending plain text.
+const APIPrefix = "/v1"
+
+// Error codes of the versioned API, these don't change
+const (
+	CodeInvalidRequest      string = "invalid_request"
+	CodeMethodNotAllowed    string = "method_not_allowed"
+	CodeNotFound            string = "not_found"
+	CodeUnauthorized        string = "unauthorized"
+	CodeForbidden           string = "forbidden"
+	CodeIPNotAllowed        string = "ip_not_allowed"
+	CodeDomainNotAllowed    string = "domain_not_allowed"
+	CodeWildcardNotAllowed  string = "wildcard_not_allowed"
+	CodeDNSBindingFailed    string = "dns_binding_failed"
+	CodeModeNotSupported    string = "mode_not_supported"
+	CodeNotOwner            string = "not_owner"
+	CodeApprovalPending     string = "approval_pending"
+	CodeTooManyAttempts     string = "too_many_attempts"
+	CodeQuotaExceeded       string = "quota_exceeded"
+	CodeDNSResolutionFailed string = "dns_resolution_failed"
+	CodeProviderFailed      string = "provider_failed"
+	CodeProviderTimeout     string = "provider_timeout"
+	CodeInternal            string = "internal_error"
+)
+
+// apiError is the body of an error response of the versioned API
+type apiError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// writeError sends an error as JSON for the versioned API, or as plain
+// text (like http.Error) for the unversioned routes
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]interface{}) {
+	if !strings.HasPrefix(r.URL.Path, APIPrefix+"/") {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message, RequestID: requestID(r), Details: details}})
+}
+
+// NotFoundHandler answers requests for unknown paths of the versioned API
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "Unknown API path", map[string]interface{}{"path": r.URL.Path})
+	})
+}
+
+type requestIDKey struct{}
+
+// validRequestID limits the request IDs taken from clients or proxies
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// RequestIDHandler gives every request an ID, taken from the X-Request-ID
+// header when there is a sane one, and sends it back in X-Request-ID
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID RequestIDHandler gave r
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,199 @@
+package acmeproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// PendingApproval is a request for a domain that hasn't been approved yet
+type PendingApproval struct {
+	Domain    string    `json:"domain"`
+	Owner     string    `json:"owner"`
+	IP        string    `json:"ip"`
+	Requested time.Time `json:"requested"`
+}
+
+// Approval lets clients request challenges for a domain
+type Approval struct {
+	Domain     string     `json:"domain"`
+	ApprovedBy string     `json:"approved_by"`
+	Approved   time.Time  `json:"approved"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// Approvals keeps the approved domains and the requests waiting for an
+// admin in the state store. A domain needs to be approved once, after
+// that (until the approval expires) requests for it go through, so
+// renewals don't need an admin.
+type Approvals struct {
+	// TTL is how long approvals last by default, zero for no expiry
+	TTL time.Duration
+	// PendingTTL is how long a pending request is kept, after that the
+	// next request for the domain is a new one
+	PendingTTL time.Duration
+	// NotifyURL gets a JSON POST for every new pending request
+	NotifyURL string
+
+	store state.Store
+}
+
+// NewApprovals returns Approvals kept in store
+func NewApprovals(store state.Store, ttl, pendingTTL time.Duration, notifyURL string) *Approvals {
+	return &Approvals{TTL: ttl, PendingTTL: pendingTTL, NotifyURL: notifyURL, store: store}
+}
+
+func approvalDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func approvalKey(domain string) string {
+	return "approvals/" + approvalDomain(domain)
+}
+
+func pendingKey(domain string) string {
+	return "approvals-pending/" + approvalDomain(domain)
+}
+
+// Approved reports whether domain has been approved
+func (a *Approvals) Approved(domain string) (bool, error) {
+	_, err := a.store.Get(approvalKey(domain))
+	if err == state.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Request records a request for domain waiting for approval and reports
+// whether it is a new one. Only new requests are notified.
+func (a *Approvals) Request(domain, owner, ip string) (bool, error) {
+	pending := &PendingApproval{Domain: approvalDomain(domain), Owner: owner, IP: ip, Requested: time.Now().Round(time.Second)}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return false, err
+	}
+	added, err := a.store.Add(pendingKey(domain), data, a.PendingTTL)
+	if err != nil || !added {
+		return false, err
+	}
+	if len(a.NotifyURL) > 0 {
+		go a.notify(pending)
+	}
+	return true, nil
+}
+
+// Approve approves domain for ttl (zero for no expiry) and drops its
+// pending request
+func (a *Approvals) Approve(domain, approvedBy string, ttl time.Duration) (*Approval, error) {
+	approval := &Approval{Domain: approvalDomain(domain), ApprovedBy: approvedBy, Approved: time.Now().Round(time.Second)}
+	if ttl > 0 {
+		expires := approval.Approved.Add(ttl)
+		approval.Expires = &expires
+	}
+	data, err := json.Marshal(approval)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.Put(approvalKey(domain), data, ttl); err != nil {
+		return nil, err
+	}
+	return approval, a.store.Delete(pendingKey(domain))
+}
+
+// Remove rejects the pending request or revokes the approval of domain
+func (a *Approvals) Remove(domain string) error {
+	for _, key := range []string{approvalKey(domain), pendingKey(domain)} {
+		if err := a.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the pending requests and the approved domains
+func (a *Approvals) List() ([]PendingApproval, []Approval, error) {
+	pending := []PendingApproval{}
+	if err := a.list("approvals-pending/", func(data []byte) error {
+		var p PendingApproval
+		if err := json.Unmarshal(data, &p); err != nil {
+			return err
+		}
+		pending = append(pending, p)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	approved := []Approval{}
+	if err := a.list("approvals/", func(data []byte) error {
+		var approval Approval
+		if err := json.Unmarshal(data, &approval); err != nil {
+			return err
+		}
+		approved = append(approved, approval)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Requested.Before(pending[j].Requested) })
+	sort.Slice(approved, func(i, j int) bool { return approved[i].Domain < approved[j].Domain })
+	return pending, approved, nil
+}
+
+func (a *Approvals) list(prefix string, f func([]byte) error) error {
+	keys, err := a.store.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, err := a.store.Get(key)
+		if err == state.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := f(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify posts a pending request to NotifyURL. The text field makes it
+// readable for Slack or Mattermost incoming webhooks.
+func (a *Approvals) notify(pending *PendingApproval) {
+	data, err := json.Marshal(struct {
+		Event string `json:"event"`
+		Text  string `json:"text"`
+		*PendingApproval
+	}{
+		Event:           "approval-pending",
+		Text:            fmt.Sprintf("acmeproxy: %s (%s, %s) requested a challenge for %s, which needs approval", pending.Owner, pending.IP, pending.Requested.Format(time.RFC3339), pending.Domain),
+		PendingApproval: pending,
+	})
+	if err == nil {
+		var resp *http.Response
+		resp, err = notifyClient.Post(a.NotifyURL, "application/json", bytes.NewReader(data))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("%s: %s", a.NotifyURL, resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix": "approval",
+			"domain": pending.Domain,
+			"error":  err.Error(),
+		}).Error("Unable to send approval notification")
+	}
+}
@@ -0,0 +1,41 @@
+package acmeproxy
+
+import (
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newAuditLogger returns a logger that writes JSON audit events to file
+func newAuditLogger(file string) (*log.Logger, error) {
+	auditLogHandle, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.New()
+	logger.SetOutput(auditLogHandle)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetLevel(log.InfoLevel)
+	return logger, nil
+}
+
+// audit records a security relevant event in the regular log and, if
+// configured, in the audit log
+func audit(r *http.Request, config *Config, event string, fields log.Fields) {
+	entry := log.WithFields(fields).WithFields(log.Fields{
+		"prefix":     "audit: " + clientIP(r),
+		"event":      event,
+		"request_id": requestID(r),
+	})
+	entry.Warning("Audit event")
+
+	if config.auditLogger != nil {
+		config.auditLogger.WithFields(fields).WithFields(log.Fields{
+			"ip":         clientIP(r),
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"request_id": requestID(r),
+		}).Info(event)
+	}
+}
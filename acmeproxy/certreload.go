@@ -0,0 +1,147 @@
+package acmeproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certExpiryWarning is how long before expiry the certificate is logged
+// as about to expire
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// CertReloader serves a certificate/key pair from disk and reloads it
+// when the files change, e.g. after an external renewal. A new pair only
+// replaces the current one when it loads and hasn't expired, so a
+// half-written renewal doesn't break TLS.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	warnedAt time.Time
+}
+
+// NewCertReloader loads the certificate/key pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, to be used as
+// tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the files for changes every interval until stop is closed
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.reload(); err != nil {
+				log.WithFields(log.Fields{
+					"prefix":    "ssl.manual",
+					"cert-file": c.certFile,
+					"key-file":  c.keyFile,
+					"error":     err.Error(),
+				}).Error("Failed to reload certificate, keeping the current one")
+			}
+			c.checkExpiry()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reload loads the pair if either file changed since the last attempt
+func (c *CertReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// Don't retry the same files over and over when they're invalid
+	c.mu.Lock()
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	c.mu.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return false, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+
+	c.mu.Lock()
+	c.cert, c.leaf = &cert, leaf
+	c.warnedAt = time.Time{}
+	c.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"prefix":   "ssl.manual",
+		"subject":  leaf.Subject.CommonName,
+		"names":    leaf.DNSNames,
+		"notAfter": leaf.NotAfter.Format(time.RFC3339),
+	}).Info("Loaded certificate")
+	c.checkExpiry()
+	return true, nil
+}
+
+// checkExpiry warns (once a day) when the certificate is about to expire
+func (c *CertReloader) checkExpiry() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	left := time.Until(c.leaf.NotAfter)
+	if left > certExpiryWarning || time.Since(c.warnedAt) < 24*time.Hour {
+		return
+	}
+	c.warnedAt = time.Now()
+	log.WithFields(log.Fields{
+		"prefix":   "ssl.manual",
+		"subject":  c.leaf.Subject.CommonName,
+		"notAfter": c.leaf.NotAfter.Format(time.RFC3339),
+	}).Warningf("Certificate expires in %s", left.Round(time.Hour))
+}
+
+// Certificates returns the certificate currently served
+func (c *CertReloader) Certificates() []CertificateInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return []CertificateInfo{NewCertificateInfo(SourceManual, c.leaf)}
+}
@@ -0,0 +1,358 @@
+// Package client talks to one or more acmeproxy servers to present and
+// clean up DNS challenges. A Client can be used directly as a lego DNS
+// provider (challenge.Provider and challenge.ProviderTimeout).
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/go-acme/lego/v3/platform/config/env"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ModeDefault   string = "default"
+	ModeRaw       string = "raw"
+	ActionPresent string = "present"
+	ActionCleanup string = "cleanup"
+)
+
+// Message represents the JSON payload in default mode
+// See https://github.com/go-acme/lego/tree/master/providers/dns/httpreq
+type Message struct {
+	FQDN     string `json:"fqdn"`
+	Value    string `json:"value"`
+	Wildcard bool   `json:"wildcard,omitempty"`
+}
+
+// RawMessage represents the JSON payload in raw mode
+// See https://github.com/go-acme/lego/tree/master/providers/dns/httpreq
+type RawMessage struct {
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"keyauth"`
+}
+
+// Config is used to configure a Client
+type Config struct {
+	// Endpoints are tried in order until one of them handles the request
+	Endpoints          []string
+	Mode               string
+	Username           string
+	Password           string
+	Token              string
+	HMACKeyID          string
+	HMACKey            string
+	SSHKeyFile         string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+	HTTPTimeout        time.Duration
+}
+
+// NewDefaultConfig returns a default configuration for a Client
+func NewDefaultConfig() *Config {
+	return &Config{
+		Mode:               ModeDefault,
+		PropagationTimeout: env.GetOrDefaultSecond("ACMEPROXY_PROPAGATION_TIMEOUT", dns01.DefaultPropagationTimeout),
+		PollingInterval:    env.GetOrDefaultSecond("ACMEPROXY_POLLING_INTERVAL", dns01.DefaultPollingInterval),
+		HTTPTimeout:        env.GetOrDefaultSecond("ACMEPROXY_HTTP_TIMEOUT", 30*time.Second),
+	}
+}
+
+// Error is returned when the acmeproxy server rejects a request
+type Error struct {
+	Endpoint   string
+	StatusCode int
+	Message    string
+	// Code and RequestID are set by the versioned (/v1) API
+	Code      string
+	RequestID string
+	// RetryAfter is the Retry-After header of the response, if any
+	RetryAfter string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+// newError returns the Error for a response body, a JSON error object
+// (from the /v1 API) or plain text
+func newError(endpoint string, statusCode int, body []byte) *Error {
+	e := &Error{Endpoint: endpoint, StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
+	var apiErr struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && len(apiErr.Error.Code) > 0 {
+		e.Message, e.Code, e.RequestID = apiErr.Error.Message, apiErr.Error.Code, apiErr.Error.RequestID
+	}
+	return e
+}
+
+var _ challenge.ProviderTimeout = (*Client)(nil)
+
+// Client sends requests to acmeproxy servers
+type Client struct {
+	config     *Config
+	endpoints  []*url.URL
+	httpClient *http.Client
+	hmacKey    []byte
+	sshSigner  ssh.Signer
+}
+
+// NewDNSProvider returns a Client configured from the ACMEPROXY_*
+// environment variables.
+func NewDNSProvider() (*Client, error) {
+	config, err := NewConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(config)
+}
+
+// NewConfigFromEnv returns a configuration read from the ACMEPROXY_*
+// environment variables. ACMEPROXY_ENDPOINT may hold a comma separated
+// list of servers to fail over between.
+func NewConfigFromEnv() (*Config, error) {
+	values, err := env.Get("ACMEPROXY_ENDPOINT")
+	if err != nil {
+		return nil, fmt.Errorf("acmeproxy: %v", err)
+	}
+
+	config := NewDefaultConfig()
+	config.Endpoints = strings.Split(values["ACMEPROXY_ENDPOINT"], ",")
+	config.Mode = env.GetOrDefaultString("ACMEPROXY_MODE", ModeDefault)
+	config.Username = env.GetOrFile("ACMEPROXY_USERNAME")
+	config.Password = env.GetOrFile("ACMEPROXY_PASSWORD")
+	config.Token = env.GetOrFile("ACMEPROXY_TOKEN")
+	config.HMACKeyID = env.GetOrFile("ACMEPROXY_HMAC_KEY_ID")
+	config.HMACKey = env.GetOrFile("ACMEPROXY_HMAC_KEY")
+	config.SSHKeyFile = env.GetOrFile("ACMEPROXY_SSH_KEY_FILE")
+	config.CAFile = env.GetOrFile("ACMEPROXY_CA_FILE")
+	config.CertFile = env.GetOrFile("ACMEPROXY_CERT_FILE")
+	config.KeyFile = env.GetOrFile("ACMEPROXY_KEY_FILE")
+	return config, nil
+}
+
+// New returns a Client for config
+func New(config *Config) (*Client, error) {
+	if config == nil {
+		return nil, errors.New("acmeproxy: the client configuration is nil")
+	}
+	if len(config.Endpoints) == 0 {
+		return nil, errors.New("acmeproxy: the server endpoint is missing")
+	}
+
+	switch strings.ToLower(config.Mode) {
+	case "", ModeDefault, ModeRaw:
+	default:
+		return nil, fmt.Errorf("acmeproxy: unknown mode %s", config.Mode)
+	}
+
+	var endpoints []*url.URL
+	for _, e := range config.Endpoints {
+		endpoint, err := url.Parse(strings.TrimSpace(e))
+		if err != nil {
+			return nil, fmt.Errorf("acmeproxy: %v", err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("acmeproxy: %v", err)
+	}
+
+	var hmacKey []byte
+	if len(config.HMACKeyID) > 0 {
+		hmacKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(config.HMACKey))
+		if err != nil || len(hmacKey) == 0 {
+			return nil, errors.New("acmeproxy: the HMAC key must be base64 encoded")
+		}
+	}
+
+	var sshSigner ssh.Signer
+	if len(config.SSHKeyFile) > 0 {
+		if sshSigner, err = LoadSSHSigner(config.SSHKeyFile); err != nil {
+			return nil, fmt.Errorf("acmeproxy: %v", err)
+		}
+	}
+
+	return &Client{
+		config:    config,
+		endpoints: endpoints,
+		hmacKey:   hmacKey,
+		sshSigner: sshSigner,
+		httpClient: &http.Client{
+			Timeout:   config.HTTPTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// newTLSConfig sets up the CA bundle and client certificate from config
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(config.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.CertFile) > 0 || len(config.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Timeout returns the timeout and interval to use when checking for DNS propagation.
+func (c *Client) Timeout() (timeout, interval time.Duration) {
+	return c.config.PropagationTimeout, c.config.PollingInterval
+}
+
+// Present creates a TXT record to fulfill the dns-01 challenge, using a
+// raw mode or default mode request depending on the configured mode. A
+// domain starting with "*." requests the record for a wildcard
+// certificate.
+func (c *Client) Present(domain, token, keyAuth string) error {
+	return c.do(ActionPresent, domain, token, keyAuth)
+}
+
+// CleanUp removes the TXT record matching the specified parameters
+func (c *Client) CleanUp(domain, token, keyAuth string) error {
+	return c.do(ActionCleanup, domain, token, keyAuth)
+}
+
+func (c *Client) do(action, domain, token, keyAuth string) error {
+	var err error
+	if strings.EqualFold(c.config.Mode, ModeRaw) {
+		err = c.Do(action, &RawMessage{Domain: domain, Token: token, KeyAuth: keyAuth})
+	} else {
+		fqdn, value := dns01.GetRecord(strings.TrimPrefix(domain, "*."), keyAuth)
+		err = c.Do(action, &Message{FQDN: fqdn, Value: value, Wildcard: strings.HasPrefix(domain, "*.")})
+	}
+	if err != nil {
+		return fmt.Errorf("acmeproxy: %w", err)
+	}
+	return nil
+}
+
+// CreateRecord creates the TXT record fqdn with value (default mode)
+func (c *Client) CreateRecord(fqdn, value string) error {
+	return c.Do(ActionPresent, &Message{FQDN: fqdn, Value: value})
+}
+
+// CreateWildcardRecord creates the TXT record fqdn with value for a
+// wildcard certificate (default mode), so the server can check its
+// wildcard rules
+func (c *Client) CreateWildcardRecord(fqdn, value string) error {
+	return c.Do(ActionPresent, &Message{FQDN: fqdn, Value: value, Wildcard: true})
+}
+
+// RemoveRecord removes value from the TXT record fqdn (default mode)
+func (c *Client) RemoveRecord(fqdn, value string) error {
+	return c.Do(ActionCleanup, &Message{FQDN: fqdn, Value: value})
+}
+
+// Do sends msg (a Message or RawMessage) to the action endpoint. Servers
+// are tried in order; the next one is only tried when a server can't be
+// reached or fails with a server error, a rejected request is returned
+// right away.
+func (c *Client) Do(action string, msg interface{}) error {
+	reqBody, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range c.endpoints {
+		err = c.post(endpoint, action, reqBody)
+		if err == nil {
+			return nil
+		}
+
+		var clientErr *Error
+		if errors.As(err, &clientErr) && clientErr.StatusCode < http.StatusInternalServerError {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (c *Client) post(endpoint *url.URL, action string, body []byte) error {
+	u, err := endpoint.Parse(path.Join(endpoint.EscapedPath(), action))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(c.config.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	} else if len(c.hmacKey) > 0 {
+		if err := SignRequest(req, c.config.HMACKeyID, c.hmacKey, body); err != nil {
+			return err
+		}
+	} else if c.sshSigner != nil {
+		if err := SSHSignRequest(req, c.sshSigner, body); err != nil {
+			return err
+		}
+	} else if len(c.config.Username) > 0 && len(c.config.Password) > 0 {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return &Error{Endpoint: endpoint.String(), StatusCode: resp.StatusCode, Message: fmt.Sprintf("failed to read response body: %v", err)}
+		}
+		e := newError(endpoint.String(), resp.StatusCode, respBody)
+		e.RetryAfter = resp.Header.Get("Retry-After")
+		return e
+	}
+
+	return nil
+}
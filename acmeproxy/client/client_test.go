@@ -0,0 +1,288 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+)
+
+// newTestClient returns a default mode client for endpoints
+func newTestClient(t *testing.T, config *Config, endpoints ...string) *Client {
+	if config == nil {
+		config = NewDefaultConfig()
+	}
+	config.Endpoints = endpoints
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// countingServer answers every request with status and body, counting
+// the requests
+func countingServer(status int, body string, hits *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestFailover(t *testing.T) {
+	// A closed server gives a network error
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		status int
+		next   bool
+	}{
+		{name: "server error", status: http.StatusServiceUnavailable, next: true},
+		{name: "bad gateway", status: http.StatusBadGateway, next: true},
+		{name: "unauthorized", status: http.StatusUnauthorized},
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "too many requests", status: http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		var firstHits, nextHits int
+		first := countingServer(test.status, "failed", &firstHits)
+		next := countingServer(http.StatusOK, "", &nextHits)
+
+		err := newTestClient(t, nil, closed.URL, first.URL, next.URL).CreateRecord("_acme-challenge.example.com.", "x")
+		first.Close()
+		next.Close()
+
+		if firstHits != 1 {
+			t.Errorf("%s: first reachable server got %d requests, want 1", test.name, firstHits)
+		}
+		if test.next {
+			if err != nil || nextHits != 1 {
+				t.Errorf("%s: got %v and %d requests to the next server, want it to succeed", test.name, err, nextHits)
+			}
+			continue
+		}
+		var clientErr *Error
+		if !errors.As(err, &clientErr) || clientErr.StatusCode != test.status {
+			t.Errorf("%s: got %v, want an Error with status %d", test.name, err, test.status)
+		}
+		if nextHits != 0 {
+			t.Errorf("%s: next server tried after a rejected request", test.name)
+		}
+	}
+}
+
+func TestFailoverAllFail(t *testing.T) {
+	var hits int
+	a := countingServer(http.StatusInternalServerError, "a failed", &hits)
+	defer a.Close()
+	b := countingServer(http.StatusServiceUnavailable, "b failed", &hits)
+	defer b.Close()
+
+	err := newTestClient(t, nil, a.URL, b.URL).CreateRecord("_acme-challenge.example.com.", "x")
+	var clientErr *Error
+	if !errors.As(err, &clientErr) || clientErr.Endpoint != b.URL || clientErr.Message != "b failed" {
+		t.Fatalf("got %v, want the error of the last server", err)
+	}
+	if hits != 2 {
+		t.Fatalf("%d requests, want 2", hits)
+	}
+}
+
+// writeSSHKey writes an ECDSA private key for signing requests to a file
+func writeSSHKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "acmeproxy-ssh-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// TestAuthPrecedence checks which credentials a request is sent with when
+// several are configured
+func TestAuthPrecedence(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	sshKey := writeSSHKey(t)
+	defer os.Remove(sshKey)
+
+	config := func(token, hmac, ssh, basic bool) *Config {
+		c := NewDefaultConfig()
+		if token {
+			c.Token = "token"
+		}
+		if hmac {
+			c.HMACKeyID, c.HMACKey = "site-a", "MDEyMzQ1Njc4OWFiY2RlZg=="
+		}
+		if ssh {
+			c.SSHKeyFile = sshKey
+		}
+		if basic {
+			c.Username, c.Password = "alice", "secret"
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		config *Config
+		prefix string
+	}{
+		{name: "all", config: config(true, true, true, true), prefix: "Bearer token"},
+		{name: "hmac, ssh and basic", config: config(false, true, true, true), prefix: SignatureScheme + " key=site-a,"},
+		{name: "ssh and basic", config: config(false, false, true, true), prefix: SSHSignatureScheme + " "},
+		{name: "basic", config: config(false, false, false, true), prefix: "Basic "},
+		{name: "none", config: config(false, false, false, false), prefix: ""},
+	}
+
+	for _, test := range tests {
+		header = "unset"
+		if err := newTestClient(t, test.config, server.URL).CreateRecord("_acme-challenge.example.com.", "x"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !strings.HasPrefix(header, test.prefix) || (test.prefix == "" && header != "") {
+			t.Errorf("%s: sent Authorization %q, want %q...", test.name, header, test.prefix)
+		}
+	}
+
+	// A user without password doesn't send basic authentication
+	c := config(false, false, false, true)
+	c.Password = ""
+	if err := newTestClient(t, c, server.URL).CreateRecord("_acme-challenge.example.com.", "x"); err != nil || header != "" {
+		t.Errorf("user without password: sent Authorization %q, %v", header, err)
+	}
+}
+
+func TestErrorBodies(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		want  Error
+		error string
+	}{
+		{
+			name: "JSON",
+			body: `{"error":{"code":"domain_not_allowed","message":"Requested domain not in allowed-domains","request_id":"abc123"}}`,
+			want: Error{StatusCode: http.StatusForbidden, Code: "domain_not_allowed", Message: "Requested domain not in allowed-domains", RequestID: "abc123"},
+		},
+		{
+			name: "plain text",
+			body: "Requested domain not in allowed-domains\n",
+			want: Error{StatusCode: http.StatusForbidden, Message: "Requested domain not in allowed-domains"},
+		},
+		{
+			name: "JSON without code",
+			body: `{"message":"denied"}`,
+			want: Error{StatusCode: http.StatusForbidden, Message: `{"message":"denied"}`},
+		},
+	}
+
+	for _, test := range tests {
+		var hits int
+		server := countingServer(http.StatusForbidden, test.body, &hits)
+		err := newTestClient(t, nil, server.URL).CreateRecord("_acme-challenge.example.com.", "x")
+		server.Close()
+
+		var clientErr *Error
+		if !errors.As(err, &clientErr) {
+			t.Errorf("%s: got %v, want an *Error", test.name, err)
+			continue
+		}
+		test.want.Endpoint = server.URL
+		if *clientErr != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *clientErr, test.want)
+		}
+		if clientErr.Error() != "403: "+test.want.Message {
+			t.Errorf("%s: message %q", test.name, clientErr.Error())
+		}
+	}
+}
+
+// TestWildcard checks default mode requests tell the server they are for
+// a wildcard certificate
+func TestWildcard(t *testing.T) {
+	var got Message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Message{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	config := NewDefaultConfig()
+	config.Endpoints = []string{server.URL}
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fqdn, value := dns01.GetRecord("example.com", "keyauth")
+	tests := []struct {
+		name     string
+		send     func() error
+		wildcard bool
+	}{
+		{name: "Present", send: func() error { return c.Present("example.com", "token", "keyauth") }},
+		{name: "Present wildcard", send: func() error { return c.Present("*.example.com", "token", "keyauth") }, wildcard: true},
+		{name: "CleanUp wildcard", send: func() error { return c.CleanUp("*.example.com", "token", "keyauth") }, wildcard: true},
+		{name: "CreateRecord", send: func() error { return c.CreateRecord(fqdn, value) }},
+		{name: "CreateWildcardRecord", send: func() error { return c.CreateWildcardRecord(fqdn, value) }, wildcard: true},
+	}
+
+	for _, test := range tests {
+		if err := test.send(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := Message{FQDN: fqdn, Value: value, Wildcard: test.wildcard}
+		if got != want {
+			t.Errorf("%s: sent %+v, want %+v", test.name, got, want)
+		}
+	}
+}
+
+func TestErrorRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	err := newTestClient(t, nil, server.URL).CreateRecord("_acme-challenge.example.com.", "x")
+	var clientErr *Error
+	if !errors.As(err, &clientErr) || clientErr.RetryAfter != "120" {
+		t.Fatalf("got %v, want an Error with Retry-After 120", err)
+	}
+}
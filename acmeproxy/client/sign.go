@@ -0,0 +1,112 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: ACMEPROXY-HMAC-SHA256 key=<key ID>, ts=<unix time>, nonce=<nonce>, sig=<signature>
+//
+// The signature is the base64 encoded HMAC-SHA256 of SigningString.
+const SignatureScheme = "ACMEPROXY-HMAC-SHA256"
+
+// SignatureParams are the parameters of a signed request
+type SignatureParams struct {
+	Scheme    string
+	KeyID     string
+	Timestamp string
+	Nonce     string
+	Signature string
+}
+
+// SigningString returns the string that is signed: the method, path,
+// timestamp, nonce and the hex encoded SHA-256 of the body, each on
+// their own line
+func SigningString(method, path, timestamp, nonce string, body []byte) string {
+	return signingString(SignatureScheme, method, path, timestamp, nonce, body)
+}
+
+func signingString(scheme, method, path, timestamp, nonce string, body []byte) string {
+	hash := sha256.Sum256(body)
+	return strings.Join([]string{scheme, method, path, timestamp, nonce, hex.EncodeToString(hash[:])}, "\n")
+}
+
+// Signature returns the base64 encoded HMAC-SHA256 of s with key
+func Signature(key []byte, s string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds the Authorization header for a request with body
+func SignRequest(req *http.Request, keyID string, key []byte, body []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	params := SignatureParams{
+		KeyID:     keyID,
+		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
+		Nonce:     nonce,
+	}
+	params.Signature = Signature(key, SigningString(req.Method, req.URL.EscapedPath(), params.Timestamp, params.Nonce, body))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s key=%s, ts=%s, nonce=%s, sig=%s",
+		SignatureScheme, params.KeyID, params.Timestamp, params.Nonce, params.Signature))
+	return nil
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ParseSignature parses the Authorization header of a signed request
+// (SignatureScheme or SSHSignatureScheme). It returns false if the header
+// uses another scheme.
+func ParseSignature(header string) (*SignatureParams, bool, error) {
+	params := &SignatureParams{}
+	for _, scheme := range []string{SignatureScheme, SSHSignatureScheme} {
+		if strings.HasPrefix(header, scheme+" ") {
+			params.Scheme = scheme
+		}
+	}
+	if len(params.Scheme) == 0 {
+		return nil, false, nil
+	}
+
+	for _, part := range strings.Split(strings.TrimPrefix(header, params.Scheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, true, fmt.Errorf("invalid signature parameter %q", part)
+		}
+		switch kv[0] {
+		case "key":
+			params.KeyID = kv[1]
+		case "ts":
+			params.Timestamp = kv[1]
+		case "nonce":
+			params.Nonce = kv[1]
+		case "sig":
+			params.Signature = kv[1]
+		}
+	}
+	// SSH signatures carry their public key
+	if (len(params.KeyID) == 0 && params.Scheme == SignatureScheme) || len(params.Timestamp) == 0 || len(params.Nonce) == 0 || len(params.Signature) == 0 {
+		return nil, true, fmt.Errorf("incomplete signature")
+	}
+	return params, true, nil
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SSHSignatureScheme is the Authorization scheme of requests signed
+	// with an SSH key:
+	//
+	//	Authorization: ACMEPROXY-SSHSIG ts=<unix time>, nonce=<nonce>, sig=<base64 SSHSIG>
+	//
+	// The signature is an SSHSIG (as made by ssh-keygen -Y sign) of
+	// SSHSigningString in the SSHNamespace namespace.
+	SSHSignatureScheme = "ACMEPROXY-SSHSIG"
+	// SSHNamespace is the SSHSIG namespace of request signatures
+	SSHNamespace = "acmeproxy"
+
+	sshsigMagic   = "SSHSIG"
+	sshsigVersion = 1
+	sshsigHash    = "sha512"
+)
+
+// sshsigBlob is an SSHSIG signature without the magic preamble, see
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+type sshsigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature []byte
+}
+
+// sshsigSignedData is what the SSH key signs
+type sshsigSignedData struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+// SSHSigningString returns the string that is signed with an SSH key, see
+// SigningString
+func SSHSigningString(method, path, timestamp, nonce string, body []byte) string {
+	return signingString(SSHSignatureScheme, method, path, timestamp, nonce, body)
+}
+
+// LoadSSHSigner loads an (unencrypted) SSH private key, e.g. a host key
+func LoadSSHSigner(file string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(pem)
+}
+
+// SSHSign returns the SSHSIG signature of message in namespace
+func SSHSign(signer ssh.Signer, namespace string, message []byte) ([]byte, error) {
+	hash := sha512.Sum512(message)
+	data := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace: namespace,
+		HashAlg:   sshsigHash,
+		Hash:      hash[:],
+	})...)
+
+	var sig *ssh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures aren't accepted
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:   sshsigVersion,
+		PublicKey: signer.PublicKey().Marshal(),
+		Namespace: namespace,
+		HashAlg:   sshsigHash,
+		Signature: ssh.Marshal(sig),
+	})...), nil
+}
+
+// SSHVerify checks the SSHSIG signature of message in namespace and
+// returns the public key that made it
+func SSHVerify(signature []byte, namespace string, message []byte) (ssh.PublicKey, error) {
+	if len(signature) < len(sshsigMagic) || string(signature[:len(sshsigMagic)]) != sshsigMagic {
+		return nil, errors.New("not an SSHSIG signature")
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(signature[len(sshsigMagic):], &blob); err != nil {
+		return nil, err
+	}
+	if blob.Version != sshsigVersion {
+		return nil, fmt.Errorf("unsupported SSHSIG version %d", blob.Version)
+	}
+	if blob.Namespace != namespace {
+		return nil, fmt.Errorf("signature for namespace %q", blob.Namespace)
+	}
+
+	var hash []byte
+	switch blob.HashAlg {
+	case "sha512":
+		h := sha512.Sum512(message)
+		hash = h[:]
+	case "sha256":
+		h := sha256.Sum256(message)
+		hash = h[:]
+	default:
+		return nil, fmt.Errorf("unsupported SSHSIG hash %q", blob.HashAlg)
+	}
+
+	key, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(blob.Signature, sig); err != nil {
+		return nil, err
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return nil, errors.New("SHA-1 RSA signatures aren't accepted")
+	}
+
+	data := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace: blob.Namespace,
+		Reserved:  blob.Reserved,
+		HashAlg:   blob.HashAlg,
+		Hash:      hash,
+	})...)
+	if err := key.Verify(data, sig); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SSHSignRequest adds the Authorization header for a request with body,
+// signed with an SSH key
+func SSHSignRequest(req *http.Request, signer ssh.Signer, body []byte) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	sig, err := SSHSign(signer, SSHNamespace, []byte(SSHSigningString(req.Method, req.URL.EscapedPath(), timestamp, nonce, body)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s ts=%s, nonce=%s, sig=%s",
+		SSHSignatureScheme, timestamp, nonce, base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
@@ -0,0 +1,121 @@
+package acmeproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// ClientIPHandler determines the client IP once per request, so the
+// filter, logs and record owners all use the same address. Forwarding
+// headers (X-Forwarded-For, X-Real-IP) are only honored when the request
+// comes from one of the trusted proxies.
+func ClientIPHandler(h http.Handler, config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, config.TrustedProxies)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the client IP found by ClientIPHandler, or the remote
+// address for requests that didn't pass through it
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the IP of the direct peer
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP returns the remote address, unless it's a trusted
+// proxy. In that case X-Forwarded-For is followed from right to left and
+// the first hop that isn't a trusted proxy is the client; without
+// X-Forwarded-For X-Real-IP is used.
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote := remoteIP(r)
+	if !trustedProxy(remote, trusted) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return remote
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// A forged or broken entry: the last proxy we trust is as far
+			// as we can go
+			break
+		}
+		client = ip.String()
+		if !containsIP(trusted, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// trustedProxy reports whether ip is one of the trusted proxies
+func trustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && containsIP(trusted, parsed)
+}
+
+// ParseCIDRs parses a list of IP addresses and CIDR networks
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is in one of nets
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
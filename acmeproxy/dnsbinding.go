@@ -0,0 +1,128 @@
+package acmeproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSBinding lets clients without credentials request challenges for
+// names that point to their own IP: the domain must have an A or AAAA
+// record with the client IP, or the PTR record of the client IP must be
+// the domain. The DNS servers are asked directly, so /etc/hosts doesn't
+// count.
+type DNSBinding struct {
+	servers []string
+	timeout time.Duration
+}
+
+// NewDNSBinding returns a DNSBinding that asks servers (host or host:port,
+// tried in order), or the servers in /etc/resolv.conf when there are none
+func NewDNSBinding(servers []string, timeout time.Duration) (*DNSBinding, error) {
+	if len(servers) == 0 {
+		config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		servers = config.Servers
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers")
+	}
+
+	b := &DNSBinding{timeout: timeout}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		b.servers = append(b.servers, server)
+	}
+	return b, nil
+}
+
+// Check reports whether domain is bound to ip. It also returns the
+// addresses of domain and the PTR names of ip, to tell why it isn't.
+func (b *DNSBinding) Check(ctx context.Context, domain string, ip string) (bool, []string, []string, error) {
+	client := parseIP(ip)
+	if client == nil {
+		return false, nil, nil, errors.New("invalid client IP")
+	}
+	domain = strings.ToLower(dns.Fqdn(domain))
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, err := b.query(ctx, domain, qtype)
+		if err != nil {
+			return false, addrs, nil, err
+		}
+		for _, rr := range answers {
+			var addr net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr = rr.A
+			case *dns.AAAA:
+				addr = rr.AAAA
+			default:
+				continue
+			}
+			addrs = append(addrs, addr.String())
+			if parseIP(addr.String()).Equal(client) {
+				return true, addrs, nil, nil
+			}
+		}
+	}
+
+	reverse, err := dns.ReverseAddr(client.String())
+	if err != nil {
+		return false, addrs, nil, err
+	}
+	answers, err := b.query(ctx, reverse, dns.TypePTR)
+	if err != nil {
+		return false, addrs, nil, err
+	}
+	var names []string
+	for _, rr := range answers {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, dns.Fqdn(strings.ToLower(ptr.Ptr)))
+			if names[len(names)-1] == domain {
+				return true, addrs, names, nil
+			}
+		}
+	}
+	return false, addrs, names, nil
+}
+
+// query returns the answers for name from the first server that answers.
+// A name that doesn't exist has no answers, a failing server is an error.
+func (b *DNSBinding) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+
+	var err error
+	for _, server := range b.servers {
+		var r *dns.Msg
+		r, _, err = (&dns.Client{}).ExchangeContext(ctx, m, server)
+		if err == nil && r.Truncated {
+			r, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, m, server)
+		}
+		if err != nil {
+			continue
+		}
+		switch r.Rcode {
+		case dns.RcodeSuccess:
+			return r.Answer, nil
+		case dns.RcodeNameError:
+			return nil, nil
+		}
+		err = fmt.Errorf("%s %s on %s: %s", name, dns.TypeToString[qtype], server, dns.RcodeToString[r.Rcode])
+	}
+	return nil, err
+}
@@ -2,9 +2,13 @@ package acmeproxy
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	golog "log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,8 +17,7 @@ import (
 	"github.com/go-acme/lego/v3/challenge"
 	"github.com/go-acme/lego/v3/challenge/dns01"
 	"golang.org/x/net/context"
-	"github.com/orange-cloudfoundry/ipfiltering"
-	"github.com/codeskyblue/realip"
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
 )
 
 const (
@@ -30,11 +33,22 @@ type providerSolved interface {
 	RemoveRecord(fqdn, value string) error
 }
 
+// providerWildcard is implemented by providers that need to know a record
+// is for a wildcard certificate, like an upstream acmeproxy. Default mode
+// records are created with CreateWildcardRecord, raw mode records are
+// presented and cleaned up for *.<domain>.
+type providerWildcard interface {
+	CreateWildcardRecord(fqdn, value string) error
+}
+
 // message represents the JSON payload
 // See https://github.com/go-acme/lego/tree/master/providers/dns/httpreq
 type messageDefault struct {
 	FQDN  string `json:"fqdn"`
 	Value string `json:"value"`
+	// Wildcard tells the record is for a wildcard certificate, which
+	// can't be told from the FQDN
+	Wildcard bool `json:"wildcard,omitempty"`
 }
 
 // message represents the JSON payload
@@ -74,23 +88,47 @@ func GetHandler(config *Config) http.Handler {
 	handlerPresent := ActionHandler(ActionPresent, config)
 	handlerCleanup := ActionHandler(ActionCleanup, config)
 
+	var authenticator AuthenticatorInterface
 	if len(config.HtpasswdFile) > 0 {
-		authenticator := &auth.BasicAuth{
+		authenticator = &auth.BasicAuth{
 			Realm:   "Basic Realm",
 			Secrets: auth.HtpasswdFileProvider(config.HtpasswdFile),
 		}
-		handlerPresent = AuthenticationHandler(handlerPresent, ActionPresent, authenticator)
-		handlerCleanup = AuthenticationHandler(handlerCleanup, ActionCleanup, authenticator)
 	}
+	if authenticator != nil || config.JWT != nil || config.HMAC != nil || config.SSH != nil {
+		handlerPresent = AuthenticationHandler(handlerPresent, ActionPresent, authenticator, config)
+		handlerCleanup = AuthenticationHandler(handlerCleanup, ActionCleanup, authenticator, config)
+	}
+
+	// The filters can change on reload, so always check them
+	handlerPresent = FilterHandler(handlerPresent, ActionPresent, config)
+	handlerCleanup = FilterHandler(handlerCleanup, ActionCleanup, config)
 
-	if len(config.AllowedIPs) > 0 {
-		handlerPresent = FilterHandler(handlerPresent, ActionPresent, config)
-		handlerCleanup = FilterHandler(handlerCleanup, ActionCleanup, config)
+	config.records = newRecordStore(config.State)
+
+	if len(config.AuditlogFile) > 0 {
+		auditLogger, err := newAuditLogger(config.AuditlogFile)
+		if err != nil {
+			panic(err)
+		}
+		config.auditLogger = auditLogger
 	}
 
+	routes := map[string]http.Handler{
+		"/present":         handlerPresent,
+		"/cleanup":         handlerCleanup,
+		"/health":          HealthHandler(config),
+		"/admin/bans":      adminHandler(BansHandler(config), "admin", authenticator, config),
+		"/admin/approvals": adminHandler(ApprovalsHandler(config), "admin", authenticator, config),
+		"/admin/quotas":    adminHandler(QuotasHandler(config), "admin", authenticator, config),
+	}
 	mux.Handle("/", HomeHandler())
-	mux.Handle("/present", handlerPresent)
-	mux.Handle("/cleanup", handlerCleanup)
+	mux.Handle(APIPrefix+"/", NotFoundHandler())
+	for path, handler := range routes {
+		// The unversioned routes stay for existing clients
+		mux.Handle(path, handler)
+		mux.Handle(APIPrefix+path, handler)
+	}
 
 	// Check if we need to write an access log
 	var handler http.Handler
@@ -99,13 +137,12 @@ func GetHandler(config *Config) http.Handler {
 		if err != nil {
 			panic(err)
 		}
-		defer accessLogHandle.Close()
 		handler = writeAccessLog(mux, accessLogHandle)
 	} else {
 		handler = mux
 	}
 
-	return handler
+	return RequestIDHandler(ClientIPHandler(handler, config))
 }
 
 func HomeHandler() http.Handler {
@@ -122,13 +159,15 @@ func ActionHandler(action string, config *Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		alog := log.WithFields(log.Fields{
-			"prefix": action + ": " + realip.FromRequest(r),
+			"prefix":     action + ": " + clientIP(r),
+			"request_id": requestID(r),
 		})
 
 
 		// Check if we're using POST
 		if r.Method != http.MethodPost {
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed, use POST", nil)
 			alog.WithField("method", r.Method).Error("Method not allowed")
 			return
 		}
@@ -137,8 +176,8 @@ func ActionHandler(action string, config *Config) http.Handler {
 		incoming := &messageIncoming{}
 		err := json.NewDecoder(r.Body).Decode(incoming)
 		if err != nil {
-			http.Error(w, "Bad JSON request", http.StatusBadRequest)
-			alog.WithField("error", err.Error()).Error("Method not allowed")
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Bad JSON request", map[string]interface{}{"error": err.Error()})
+			alog.WithField("error", err.Error()).Error("Bad JSON request")
 			return
 		}
 
@@ -166,26 +205,37 @@ func ActionHandler(action string, config *Config) http.Handler {
 				"keyAuth": incoming.KeyAuth,
 			}).Debug("Received JSON payload (raw mode)")
 		} else {
-			http.Error(w, "Wrong JSON content", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, CodeInvalidRequest, "Wrong JSON content, expected fqdn and value or domain with token or keyauth", nil)
 			alog.WithField("json", incoming).Error("Wrong JSON content")
 			return
 		}
 
+		// Raw mode wildcards are requested for *.<domain>, their record
+		// is that of <domain>
+		wildcard := incoming.Wildcard
+		if mode == ModeRaw && strings.HasPrefix(checkDomain, "*.") {
+			wildcard = true
+			checkDomain = strings.TrimPrefix(checkDomain, "*.")
+			incoming.Domain = checkDomain
+		}
+
 		// Check if we are allowed to requests certificates for this domain
 		var allowed = false
+		var zone string
 		for _, allowedDomain := range config.AllowedDomains {
 			alog.WithFields(log.Fields{
 				"checkDomain":   checkDomain,
 				"allowedDomain": allowedDomain,
 			}).Debug("Checking allowed domain")
-			if checkDomain == allowedDomain || strings.HasSuffix(strings.SplitAfterN(checkDomain, ".", 2)[1], allowedDomain) {
+			if domainMatches(checkDomain, allowedDomain) {
 				allowed = true
+				zone = allowedDomain
 				break
 			}
 		}
 
 		if !allowed {
-			http.Error(w, "Requested domain not in allowed-domains", http.StatusInternalServerError)
+			writeError(w, r, http.StatusForbidden, CodeDomainNotAllowed, "Requested domain not in allowed-domains", map[string]interface{}{"domain": checkDomain})
 			alog.WithFields(log.Fields{
 				"domain":          checkDomain,
 				"allowed-domains": config.AllowedDomains,
@@ -193,122 +243,326 @@ func ActionHandler(action string, config *Config) http.Handler {
 			return
 		}
 
+		// Tokens can limit the domains further
+		id := requestIdentity(r, config)
+		if !id.Allowed(checkDomain) {
+			writeError(w, r, http.StatusForbidden, CodeDomainNotAllowed, "Requested domain not allowed for this token", map[string]interface{}{"domain": checkDomain})
+			audit(r, config, "domain-not-allowed", log.Fields{
+				"owner":   id.Owner(),
+				"domain":  checkDomain,
+				"domains": id.Domains,
+			})
+			return
+		}
+
+		// Wildcards can be limited per domain and owner
+		if wildcard && config.Wildcards != nil {
+			if ok, rule := config.Wildcards.Allowed(checkDomain, id); !ok {
+				writeError(w, r, http.StatusForbidden, CodeWildcardNotAllowed, "Wildcard not allowed for requested domain", map[string]interface{}{"domain": checkDomain})
+				audit(r, config, "wildcard-denied", log.Fields{
+					"owner":  id.Owner(),
+					"domain": checkDomain,
+					"mode":   mode,
+					"rule":   rule,
+				})
+				return
+			}
+		}
+
+		// Clients without credentials must be the host they request
+		// a challenge for
+		if id.Kind == IdentityIP && config.DNSBinding != nil {
+			bound, addrs, names, err := config.DNSBinding.Check(r.Context(), checkDomain, id.Name)
+			if err != nil {
+				writeError(w, r, http.StatusBadGateway, CodeDNSResolutionFailed, "Unable to check DNS binding", map[string]interface{}{"domain": checkDomain})
+				alog.WithFields(log.Fields{
+					"domain": checkDomain,
+					"error":  err.Error(),
+				}).Error("Unable to check DNS binding")
+				return
+			}
+			if !bound {
+				writeError(w, r, http.StatusForbidden, CodeDNSBindingFailed, "Requested domain does not resolve to the client IP", map[string]interface{}{
+					"domain":    checkDomain,
+					"ip":        id.Name,
+					"addresses": addrs,
+					"ptr":       names,
+				})
+				audit(r, config, "dns-binding-failed", log.Fields{
+					"domain":    checkDomain,
+					"addresses": addrs,
+					"ptr":       names,
+				})
+				return
+			}
+			alog.WithFields(log.Fields{
+				"domain":    checkDomain,
+				"addresses": addrs,
+				"ptr":       names,
+			}).Debug("Requested domain resolves to the client IP")
+		}
+
+		// Domains that weren't approved before wait for an admin
+		if action == ActionPresent && config.Approvals != nil {
+			approved, err := config.Approvals.Approved(checkDomain)
+			var isNew bool
+			if err == nil && !approved {
+				isNew, err = config.Approvals.Request(checkDomain, id.Owner(), clientIP(r))
+			}
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to check approval", nil)
+				alog.WithFields(log.Fields{
+					"domain": checkDomain,
+					"error":  err.Error(),
+				}).Error("Unable to check approval")
+				return
+			}
+			if !approved {
+				if isNew {
+					audit(r, config, "approval-pending", log.Fields{
+						"owner":  id.Owner(),
+						"domain": checkDomain,
+					})
+				}
+				writeError(w, r, http.StatusConflict, CodeApprovalPending, "Requested domain is pending approval", map[string]interface{}{"domain": checkDomain})
+				return
+			}
+		}
+
 		// Check if this provider supports the selected mode
 		// We assume that all providers support MODE_RAW (which is lego default)
+		rec := record{Mode: mode, Wildcard: wildcard}
 		if mode == ModeDefault {
-			provider, ok := config.Provider.(providerSolved)
-			if ok {
+			if _, ok := config.Provider.(providerSolved); !ok {
+				writeError(w, r, http.StatusBadRequest, CodeModeNotSupported, "Provider does not support requested mode, use raw mode", map[string]interface{}{"mode": mode})
 				alog.WithFields(log.Fields{
 					"provider": config.ProviderName,
 					"mode":     mode,
-				}).Debug("Provider supports requested mode")
-
-				if action == ActionPresent {
-					err = provider.CreateRecord(incoming.FQDN, incoming.Value)
-				} else if action == ActionCleanup {
-					err = provider.RemoveRecord(incoming.FQDN, incoming.Value)
-				} else {
-					alog.WithFields(log.Fields{
-						"provider": config.ProviderName,
-						"fqdn":     incoming.FQDN,
-						"value":    incoming.Value,
-						"mode":     mode,
-						"error":    err.Error(),
-					}).Error("Wrong action specified")
-					http.Error(w, "Wrong action specified", http.StatusInternalServerError)
-					return
-				}
-
-				if err != nil {
-					alog.WithFields(log.Fields{
-						"provider": config.ProviderName,
-						"fqdn":     incoming.FQDN,
-						"value":    incoming.Value,
-						"mode":     mode,
-						"error":    err.Error(),
-					}).Error("Failed to update TXT record")
-					http.Error(w, "Failed to update TXT record", http.StatusInternalServerError)
+				}).Debug("Provider does not support requested mode")
+				return
+			}
+			rec.FQDN, rec.Value = incoming.FQDN, incoming.Value
+		} else {
+			rec.FQDN, rec.Value = dns01.GetRecord(incoming.Domain, incoming.KeyAuth)
+			rec.Domain, rec.Token, rec.KeyAuth = incoming.Domain, incoming.Token, incoming.KeyAuth
+		}
+		alog.WithFields(log.Fields{
+			"provider": config.ProviderName,
+			"mode":     mode,
+		}).Debug("Provider supports requested mode")
+
+		// Long term quotas catch runaway automation
+		var charge func() error
+		if action == ActionPresent && config.Quotas != nil {
+			name := checkDomain
+			if wildcard {
+				name = "*." + checkDomain
+			}
+			reservation, err := config.Quotas.Reserve(id.Owner(), name)
+			if err != nil {
+				if exceeded, ok := err.(*QuotaExceededError); ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(exceeded.Reset).Seconds())+1))
+					writeError(w, r, http.StatusTooManyRequests, CodeQuotaExceeded, "Quota exceeded: "+exceeded.describe(), map[string]interface{}{
+						"quota":   exceeded.Quota,
+						"subject": exceeded.Subject,
+						"used":    exceeded.Used,
+						"limit":   exceeded.Limit,
+						"reset":   exceeded.Reset,
+					})
+					audit(r, config, "quota-exceeded", log.Fields{
+						"owner":   id.Owner(),
+						"domain":  name,
+						"quota":   exceeded.Quota,
+						"subject": exceeded.Subject,
+						"limit":   exceeded.Limit,
+						"reset":   exceeded.Reset,
+					})
 					return
 				}
-			} else {
-				http.Error(w, "Provider does not support requested mode", http.StatusInternalServerError)
-				alog.WithFields(log.Fields{
-					"provider": config.ProviderName,
-					"mode":     mode,
-				}).Debug("Provider does not support requested mode")
+				writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to check quota", nil)
+				alog.WithField("error", err.Error()).Error("Unable to check quota")
 				return
 			}
+			// Only a successful present is charged
+			defer reservation.Release()
+			charge = reservation.Charge
+		}
 
-			// Send back the original JSON to confirm success
-			m := messageDefault{FQDN: incoming.FQDN, Value: incoming.Value}
-			w.Header().Set("Content-Type", "application/json")
-			returnErr := json.NewEncoder(w).Encode(m)
-			if returnErr != nil {
-				log.Error("Problem encoding return message")
-			}
+		rlog := alog.WithFields(log.Fields{
+			"provider": config.ProviderName,
+			"fqdn":     rec.FQDN,
+			"value":    rec.Value,
+			"mode":     mode,
+		})
+		if mode == ModeRaw {
+			rlog = rlog.WithFields(log.Fields{
+				"domain":  rec.Domain,
+				"token":   rec.Token,
+				"keyAuth": rec.KeyAuth,
+			})
+		}
 
-			// Succes!
-			alog.WithFields(log.Fields{
-				"provider": config.ProviderName,
-				"fqdn":     incoming.FQDN,
-				"value":    incoming.Value,
-				"mode":     mode,
-			}).Info("Sucessfully updated TXT record")
-			// All lego providers should support raw mode
-		} else if mode == ModeRaw {
-			fqdn, value := dns01.GetRecord(incoming.Domain, incoming.KeyAuth)
-			alog.WithFields(log.Fields{
-				"provider": config.ProviderName,
-				"mode":     mode,
-			}).Debug("Provider supports requested mode")
-			provider := config.Provider
-			err = provider.Present(incoming.Domain, incoming.Token, incoming.KeyAuth)
-			if err != nil {
-				alog.WithFields(log.Fields{
-					"provider": config.ProviderName,
-					"domain":   incoming.Domain,
-					"fqdn":     fqdn,
-					"token":    incoming.Token,
-					"keyAuth":  incoming.KeyAuth,
-					"value":    value,
-					"mode":     mode,
-				}).Error("Failed to update TXT record")
-				http.Error(w, "Failed to update TXT record", http.StatusInternalServerError)
+		rlog = rlog.WithField("owner", id.Owner())
+		switch action {
+		case ActionPresent:
+			err = config.records.present(config.Provider, zone, id.Owner(), rec)
+		case ActionCleanup:
+			var live int
+			live, err = config.records.cleanup(config.Provider, zone, id.Owner(), id.Admin, rec)
+			if errors.Is(err, errNotOwner) {
+				writeError(w, r, http.StatusForbidden, CodeNotOwner, "TXT record value is owned by another client", map[string]interface{}{"fqdn": rec.FQDN})
+				audit(r, config, "cleanup-not-owner", log.Fields{
+					"owner": id.Owner(),
+					"fqdn":  rec.FQDN,
+					"value": rec.Value,
+				})
 				return
+			} else if err == nil && live > 0 {
+				rlog.WithField("remaining", live).Info("Other values still present, keeping TXT record")
 			}
-			// Send back the original JSON to confirm success
-			m := messageRaw{Domain: incoming.Domain, Token: incoming.Token, KeyAuth: incoming.KeyAuth}
-			w.Header().Set("Content-Type", "application/json")
-			returnErr := json.NewEncoder(w).Encode(m)
-			if returnErr != nil {
-				log.Error("Problem encoding return message")
+		default:
+			rlog.Error("Wrong action specified")
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "Wrong action specified", nil)
+			return
+		}
+
+		if err != nil {
+			rlog.WithField("error", err.Error()).Error("Failed to update TXT record")
+			writeProviderError(w, r, err)
+			return
+		}
+		if charge != nil {
+			if err := charge(); err != nil {
+				rlog.WithField("error", err.Error()).Error("Unable to count quota")
 			}
+		}
 
-			// Succes!
-			alog.WithFields(log.Fields{
-				"provider": config.ProviderName,
-				"domain":   incoming.Domain,
-				"fqdn":     fqdn,
-				"token":    incoming.Token,
-				"keyAuth":  incoming.KeyAuth,
-				"value":    value,
-				"mode":     mode,
-			}).Info("Sucessfully updated TXT record")
+		// Send back the original JSON to confirm success
+		var m interface{}
+		if mode == ModeDefault {
+			m = messageDefault{FQDN: incoming.FQDN, Value: incoming.Value}
 		} else {
-			http.Error(w, "Unkown mode requested", http.StatusInternalServerError)
-			alog.WithFields(log.Fields{
-				"provider": config.ProviderName,
-				"mode":     mode,
-			}).Info("Unknown mode requested")
-			return
+			m = messageRaw{Domain: incoming.Domain, Token: incoming.Token, KeyAuth: incoming.KeyAuth}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		returnErr := json.NewEncoder(w).Encode(m)
+		if returnErr != nil {
+			log.Error("Problem encoding return message")
 		}
 
+		// Succes!
+		rlog.Info("Sucessfully updated TXT record")
 	})
 
 }
 
-func AuthenticationHandler(h http.Handler, action string, a AuthenticatorInterface) http.Handler {
+// writeProviderError sends back the error for a failed provider. Errors
+// from an upstream acmeproxy keep their message, code and status, except
+// that a rejection of our own credentials (401/403) is a 502: the client
+// did authenticate correctly. Retry-After is passed on with 429 and 503.
+func writeProviderError(w http.ResponseWriter, r *http.Request, err error) {
+	var upstreamErr *client.Error
+	if errors.As(err, &upstreamErr) {
+		status := upstreamErr.StatusCode
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			status = http.StatusBadGateway
+		}
+		if (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) && len(upstreamErr.RetryAfter) > 0 {
+			w.Header().Set("Retry-After", upstreamErr.RetryAfter)
+		}
+		details := map[string]interface{}{"upstream_status": upstreamErr.StatusCode}
+		if len(upstreamErr.Code) > 0 {
+			details["upstream_code"] = upstreamErr.Code
+		}
+		writeError(w, r, status, CodeProviderFailed, upstreamErr.Message, details)
+		return
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		writeError(w, r, http.StatusGatewayTimeout, CodeProviderTimeout, "Timeout while updating TXT record", nil)
+		return
+	}
+	writeError(w, r, http.StatusBadGateway, CodeProviderFailed, "Failed to update TXT record", nil)
+}
+
+func AuthenticationHandler(h http.Handler, action string, a AuthenticatorInterface, config *Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Local users in allowed-uids are identified by their peer credentials
+		if peer, ok := peerFromRequest(r); ok && peerAllowed(peer, config.AllowedUIDs) {
+			log.WithFields(log.Fields{
+				"uid":      peer.UID,
+				"username": peer.Username(),
+			}).Info("Authorized (peer credentials)")
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Banned IPs and usernames don't get to try a password
+		username, _, hasCredentials := r.BasicAuth()
+		if config.Lockout != nil && lockedOut(w, r, config, username, hasCredentials) {
+			return
+		}
+
+		// With dns-binding, clients without credentials are checked by
+		// the domain they request. Clients on a unix socket have no IP to
+		// check, they must be in allowed-uids or authenticate.
+		_, onSocket := peerFromRequest(r)
+		if config.DNSBinding != nil && !onSocket && len(r.Header.Get("Authorization")) == 0 {
+			log.Info("No credentials, checking DNS binding")
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Workloads authenticate with a JWT from one of the jwt.issuers
+		if token, ok := bearerToken(r); ok && config.JWT != nil {
+			id, err := config.JWT.Authenticate(token)
+			if err != nil {
+				if config.Lockout != nil {
+					recordFailure(r, config, "")
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
+				log.WithField("error", err.Error()).Warning("Unauthorized request (invalid token)")
+				return
+			}
+			if config.Lockout != nil {
+				config.Lockout.Succeed(BanIP, clientIP(r))
+			}
+			log.WithFields(log.Fields{
+				"subject": id.Name,
+				"domains": id.Domains,
+			}).Info("Authorized (token)")
+			h.ServeHTTP(w, withIdentity(r, id))
+			return
+		}
+		// Signed requests don't send a password at all
+		if params, signed, err := client.ParseSignature(r.Header.Get("Authorization")); signed && (config.HMAC != nil || config.SSH != nil) {
+			var id identity
+			if err == nil {
+				id, err = authenticateSignature(r, params, config)
+			}
+			if err != nil {
+				if config.Lockout != nil {
+					recordFailure(r, config, "")
+				}
+				writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
+				log.WithField("error", err.Error()).Warning("Unauthorized request (invalid signature)")
+				return
+			}
+			if config.Lockout != nil {
+				config.Lockout.Succeed(BanIP, clientIP(r))
+			}
+			log.WithField("key", id.Owner()).Info("Authorized (signed request)")
+			h.ServeHTTP(w, withIdentity(r, id))
+			return
+		}
+		if a == nil {
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
+			log.Warning("Unauthorized request")
+			return
+		}
+
 		ctx := a.NewContext(r.Context(), r)
 		r = r.WithContext(ctx)
 
@@ -316,10 +570,19 @@ func AuthenticationHandler(h http.Handler, action string, a AuthenticatorInterfa
 		authInfo := auth.FromContext(r.Context())
 		authInfo.UpdateHeaders(w.Header())
 		if authInfo == nil || !authInfo.Authenticated {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			// Only requests with credentials count as failed attempts,
+			// the first request of a client is usually without them
+			if config.Lockout != nil && hasCredentials {
+				recordFailure(r, config, username)
+			}
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, http.StatusText(http.StatusUnauthorized), nil)
 			log.Warning("Unauthorized request")
 			return
 		}
+		if config.Lockout != nil {
+			config.Lockout.Succeed(BanIP, clientIP(r))
+			config.Lockout.Succeed(BanUser, authInfo.Username)
+		}
 		log.WithField("username", authInfo.Username).Info("Authorized")
 		h.ServeHTTP(w, r)
 	})
@@ -328,19 +591,26 @@ func AuthenticationHandler(h http.Handler, action string, a AuthenticatorInterfa
 func FilterHandler(h http.Handler, action string, config *Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		ip := realip.FromRequest(r)
+		// Requests on unix sockets have no IP, access is limited by the
+		// socket permissions instead
+		if _, ok := peerFromRequest(r); ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
 		flog := log.WithFields(log.Fields{
 			"prefix": action + ": " + ip,
-			"ip": ip,
+			"ip":     ip,
 		})
 
-		//ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-		f := ipfiltering.New(ipfiltering.Options{AllowedIPs: config.AllowedIPs, BlockByDefault: true, Logger: flog})
-		if !f.Allowed(ip) {
-			http.Error(w, "Requesting IP not in allowed-ips", http.StatusForbidden)
-			flog.Warning("Access denied")
+		allowed, rule := config.IPFilters()[action].Allowed(ip)
+		if !allowed {
+			writeError(w, r, http.StatusForbidden, CodeIPNotAllowed, "Requesting IP not allowed", nil)
+			flog.WithField("rule", rule).Warning("Access denied")
 			return
 		}
+		flog.WithField("rule", rule).Debug("Access allowed")
 		//success!
 		h.ServeHTTP(w, r)
 	})
@@ -356,9 +626,32 @@ func writeAccessLog(handle http.Handler, accessLogHandle *os.File) http.HandlerF
 		statusCode := writer.status
 		length := writer.length
 		if request.URL.RawQuery != "" {
-			logger.Printf("%v %s %s \"%s %s%s%s %s\" %d %d \"%s\"", end.Format("2006/01/02 15:04:05"), request.Host, realip.FromRequest(request), request.Method, request.URL.Path, "?", request.URL.RawQuery, request.Proto, statusCode, length, request.Header.Get("User-Agent"))
+			logger.Printf("%v %s %s \"%s %s%s%s %s\" %d %d \"%s\"", end.Format("2006/01/02 15:04:05"), request.Host, clientIP(request), request.Method, request.URL.Path, "?", request.URL.RawQuery, request.Proto, statusCode, length, request.Header.Get("User-Agent"))
 		} else {
-			logger.Printf("%v %s %s \"%s %s %s\" %d %d \"%s\"", end.Format("2006/01/02 15:04:05"), request.Host, realip.FromRequest(request), request.Method, request.URL.Path, request.Proto, statusCode, length, request.Header.Get("User-Agent"))
+			logger.Printf("%v %s %s \"%s %s %s\" %d %d \"%s\"", end.Format("2006/01/02 15:04:05"), request.Host, clientIP(request), request.Method, request.URL.Path, request.Proto, statusCode, length, request.Header.Get("User-Agent"))
 		}
 	}
 }
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, len(token) > 0
+}
+
+// authenticateSignature checks a signed request with the authenticator
+// for its scheme
+func authenticateSignature(r *http.Request, params *client.SignatureParams, config *Config) (identity, error) {
+	switch {
+	case params.Scheme == client.SignatureScheme && config.HMAC != nil:
+		keyID, err := config.HMAC.Authenticate(r, params)
+		return identity{Kind: IdentityHMAC, Name: keyID}, err
+	case params.Scheme == client.SSHSignatureScheme && config.SSH != nil:
+		return config.SSH.Authenticate(r, params)
+	}
+	return identity{}, fmt.Errorf("%s signatures aren't accepted", params.Scheme)
+}
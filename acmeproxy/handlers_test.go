@@ -0,0 +1,184 @@
+package acmeproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+// TestAuthenticationDNSBinding checks that only clients with an IP get
+// in without credentials when dns-binding is set
+func TestAuthenticationDNSBinding(t *testing.T) {
+	config := &Config{DNSBinding: &DNSBinding{}, AllowedUIDs: []string{"4242"}}
+
+	tests := []struct {
+		name   string
+		peer   *peerCredentials
+		status int
+	}{
+		{name: "TCP without credentials", status: http.StatusOK},
+		{name: "unix socket, allowed uid", peer: &peerCredentials{UID: 4242}, status: http.StatusOK},
+		{name: "unix socket, other uid", peer: &peerCredentials{UID: 4343}, status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		var id identity
+		h := AuthenticationHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id = requestIdentity(r, config)
+		}), ActionPresent, nil, config)
+
+		r := httptest.NewRequest(http.MethodPost, "/present", nil)
+		if test.peer != nil {
+			r = r.WithContext(context.WithValue(r.Context(), peerKey{}, test.peer))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == http.StatusOK && test.peer == nil && id.Kind != IdentityIP {
+			t.Errorf("%s: got identity %+v, want an IP checked by DNS binding", test.name, id)
+		}
+	}
+}
+
+func TestWriteProviderError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+		details    string
+	}{
+		{
+			name:    "upstream rejects our credentials",
+			err:     &client.Error{StatusCode: http.StatusUnauthorized, Code: CodeUnauthorized, Message: "Unauthorized"},
+			status:  http.StatusBadGateway,
+			details: `{"upstream_code":"unauthorized","upstream_status":401}`,
+		},
+		{
+			name:    "upstream forbids",
+			err:     &client.Error{StatusCode: http.StatusForbidden, Code: CodeDomainNotAllowed, Message: "Requested domain not in allowed-domains"},
+			status:  http.StatusBadGateway,
+			details: `{"upstream_code":"domain_not_allowed","upstream_status":403}`,
+		},
+		{
+			name:       "upstream quota",
+			err:        fmt.Errorf("acmeproxy: %w", &client.Error{StatusCode: http.StatusTooManyRequests, Code: CodeQuotaExceeded, Message: "Quota exceeded", RetryAfter: "120"}),
+			status:     http.StatusTooManyRequests,
+			retryAfter: "120",
+			details:    `{"upstream_code":"quota_exceeded","upstream_status":429}`,
+		},
+		{
+			name:       "upstream unavailable",
+			err:        &client.Error{StatusCode: http.StatusServiceUnavailable, Message: "down", RetryAfter: "30"},
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "30",
+			details:    `{"upstream_status":503}`,
+		},
+		{
+			name:    "upstream bad request",
+			err:     &client.Error{StatusCode: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "Bad JSON request", RetryAfter: "5"},
+			status:  http.StatusBadRequest,
+			details: `{"upstream_code":"invalid_request","upstream_status":400}`,
+		},
+		{
+			name:   "provider",
+			err:    errors.New("no such zone"),
+			status: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeProviderError(w, httptest.NewRequest(http.MethodPost, APIPrefix+"/present", nil), test.err)
+
+		var body struct {
+			Error struct {
+				Code    string          `json:"code"`
+				Details json.RawMessage `json:"details"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if w.Code != test.status || body.Error.Code != CodeProviderFailed {
+			t.Errorf("%s: got %d %s, want %d %s", test.name, w.Code, body.Error.Code, test.status, CodeProviderFailed)
+		}
+		if got := w.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("%s: Retry-After %q, want %q", test.name, got, test.retryAfter)
+		}
+		if details := string(body.Error.Details); details != test.details {
+			t.Errorf("%s: details %s, want %s", test.name, details, test.details)
+		}
+	}
+}
+
+// TestChainedWildcard checks a wildcard request is still a wildcard at an
+// upstream acmeproxy, which can deny it
+func TestChainedWildcard(t *testing.T) {
+	wildcards, err := NewWildcardPolicy([]string{"deny example.com"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{client.ModeRaw, client.ModeDefault} {
+		upstreamProvider := newFakeProvider()
+		upstreamConfig := &Config{
+			AllowedDomains: []string{"example.com"},
+			Provider:       upstreamProvider,
+			Wildcards:      wildcards,
+			records:        newRecordStore(state.NewMemoryStore()),
+		}
+		mux := http.NewServeMux()
+		mux.Handle(APIPrefix+"/present", ActionHandler(ActionPresent, upstreamConfig))
+		mux.Handle(APIPrefix+"/cleanup", ActionHandler(ActionCleanup, upstreamConfig))
+		upstream := httptest.NewServer(mux)
+		defer upstream.Close()
+
+		clientConfig := client.NewDefaultConfig()
+		clientConfig.Mode = mode
+		clientConfig.Endpoints = []string{upstream.URL + APIPrefix}
+		provider, err := client.New(clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{
+			AllowedDomains: []string{"example.com"},
+			Provider:       provider,
+			records:        newRecordStore(state.NewMemoryStore()),
+		}
+		h := ActionHandler(ActionPresent, config)
+
+		// The proxy in front takes raw mode requests from lego
+		present := func(domain string) (int, string) {
+			r := httptest.NewRequest(http.MethodPost, APIPrefix+"/present", strings.NewReader(`{"domain":"`+domain+`","token":"t","keyAuth":"k"}`))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w.Code, w.Body.String()
+		}
+
+		if code, body := present("*.example.com"); code != http.StatusBadGateway || !strings.Contains(body, `"upstream_code":"`+CodeWildcardNotAllowed+`"`) {
+			t.Errorf("%s mode upstream, wildcard: got status %d (%s), want %d with upstream code %s", mode, code, body, http.StatusBadGateway, CodeWildcardNotAllowed)
+		}
+		if upstreamProvider.values() != 0 {
+			t.Errorf("%s mode upstream, wildcard: %d values in DNS, want 0", mode, upstreamProvider.values())
+		}
+		if code, body := present("example.com"); code != http.StatusOK {
+			t.Errorf("%s mode upstream: got status %d (%s), want %d", mode, code, body, http.StatusOK)
+		}
+		if upstreamProvider.values() != 1 {
+			t.Errorf("%s mode upstream: %d values in DNS, want 1", mode, upstreamProvider.values())
+		}
+	}
+}
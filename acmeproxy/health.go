@@ -0,0 +1,120 @@
+package acmeproxy
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SourceManual     string = "manual"
+	SourceAuto       string = "auto"
+	SourceSelfSigned string = "self-signed"
+
+	HealthOK       string = "ok"
+	HealthDegraded string = "degraded"
+	HealthExpired  string = "expired"
+)
+
+// CertificateInfo describes a certificate acmeproxy serves
+type CertificateInfo struct {
+	Source   string    `json:"source"`
+	Subject  string    `json:"subject"`
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	Expired  bool      `json:"expired"`
+}
+
+// NewCertificateInfo describes the certificate leaf from source
+func NewCertificateInfo(source string, leaf *x509.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Source:   source,
+		Subject:  leaf.Subject.CommonName,
+		Names:    leaf.DNSNames,
+		NotAfter: leaf.NotAfter,
+		Expired:  time.Now().After(leaf.NotAfter),
+	}
+}
+
+// CertificateSource is implemented by everything that serves
+// certificates, so they show up in the health status
+type CertificateSource interface {
+	Certificates() []CertificateInfo
+}
+
+// DegradedReporter is implemented by certificate sources that can run
+// degraded, e.g. while they fail to obtain a certificate
+type DegradedReporter interface {
+	Degraded() []string
+}
+
+// health is the JSON response of /health
+type health struct {
+	Status       string            `json:"status"`
+	Certificates []CertificateInfo `json:"certificates"`
+	Problems     []string          `json:"problems,omitempty"`
+}
+
+// HealthHandler reports the status of acmeproxy and the certificates it
+// serves. It returns 503 when one of the certificates has expired; a
+// degraded status (e.g. a certificate that couldn't be obtained yet) is
+// reported with 200, as requests are still served. Clients the IP filter
+// for /present rejects only get the status, without certificates or
+// problems.
+func HealthHandler(config *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed), nil)
+			return
+		}
+
+		h := health{Status: HealthOK, Certificates: []CertificateInfo{}}
+		for _, source := range config.CertificateSources {
+			if reporter, ok := source.(DegradedReporter); ok {
+				h.Problems = append(h.Problems, reporter.Degraded()...)
+			}
+			for _, cert := range source.Certificates() {
+				if cert.Expired {
+					h.Problems = append(h.Problems, "certificate for "+cert.Subject+" has expired")
+				}
+				h.Certificates = append(h.Certificates, cert)
+			}
+		}
+		for _, cert := range h.Certificates {
+			if cert.Expired {
+				h.Status = HealthExpired
+			}
+		}
+		if h.Status == HealthOK && len(h.Problems) > 0 {
+			h.Status = HealthDegraded
+		}
+
+		var response interface{} = h
+		if !healthDetailsAllowed(r, config) {
+			response = struct {
+				Status string `json:"status"`
+			}{h.Status}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if h.Status == HealthExpired {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Error("Problem encoding health status")
+		}
+	})
+}
+
+// healthDetailsAllowed reports whether r may see the certificates and
+// problems: clients on a unix socket and clients allowed to /present
+func healthDetailsAllowed(r *http.Request, config *Config) bool {
+	if _, ok := peerFromRequest(r); ok {
+		return true
+	}
+	allowed, _ := config.IPFilters()[ActionPresent].Allowed(clientIP(r))
+	return allowed
+}
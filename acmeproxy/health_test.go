@@ -0,0 +1,89 @@
+package acmeproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testSource is a certificate source with fixed certificates and problems
+type testSource struct {
+	certs    []CertificateInfo
+	problems []string
+}
+
+func (s *testSource) Certificates() []CertificateInfo { return s.certs }
+func (s *testSource) Degraded() []string              { return s.problems }
+
+func TestHealthHandler(t *testing.T) {
+	valid := CertificateInfo{Source: SourceAuto, Subject: "acmeproxy.example.com", NotAfter: time.Now().Add(time.Hour)}
+	expired := CertificateInfo{Source: SourceManual, Subject: "old.example.com", NotAfter: time.Now().Add(-time.Hour), Expired: true}
+
+	tests := []struct {
+		name   string
+		source *testSource
+		status string
+		code   int
+	}{
+		{name: "ok", source: &testSource{certs: []CertificateInfo{valid}}, status: HealthOK, code: http.StatusOK},
+		// Requests are still served with a stand-in certificate
+		{name: "degraded", source: &testSource{certs: []CertificateInfo{valid}, problems: []string{"no certificate for acmeproxy.example.org yet"}}, status: HealthDegraded, code: http.StatusOK},
+		{name: "expired", source: &testSource{certs: []CertificateInfo{valid, expired}}, status: HealthExpired, code: http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		config := &Config{CertificateSources: []CertificateSource{test.source}}
+		w := httptest.NewRecorder()
+		HealthHandler(config).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		var h health
+		if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if w.Code != test.code || h.Status != test.status {
+			t.Errorf("%s: got %d %s, want %d %s", test.name, w.Code, h.Status, test.code, test.status)
+		}
+	}
+}
+
+func TestHealthHandlerIPFilter(t *testing.T) {
+	filter, err := NewIPFilter([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{CertificateSources: []CertificateSource{&testSource{
+		certs:    []CertificateInfo{{Source: SourceAuto, Subject: "acmeproxy.example.com", NotAfter: time.Now().Add(time.Hour)}},
+		problems: []string{"no certificate for acmeproxy.example.org yet"},
+	}}}
+	config.SetIPFilters(map[string]*IPFilter{ActionPresent: filter})
+
+	tests := []struct {
+		ip      string
+		details bool
+	}{
+		{ip: "192.0.2.10", details: true},
+		{ip: "198.51.100.10"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		r.RemoteAddr = test.ip + ":1234"
+		w := httptest.NewRecorder()
+		HealthHandler(config).ServeHTTP(w, r)
+
+		var h map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+			t.Fatalf("%s: %v", test.ip, err)
+		}
+		if w.Code != http.StatusOK || h["status"] != HealthDegraded {
+			t.Errorf("%s: got %d %v, want %d %s", test.ip, w.Code, h["status"], http.StatusOK, HealthDegraded)
+		}
+		_, certificates := h["certificates"]
+		_, problems := h["problems"]
+		if certificates != test.details || problems != test.details {
+			t.Errorf("%s: got %v, want details %v", test.ip, h, test.details)
+		}
+	}
+}
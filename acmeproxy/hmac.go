@@ -0,0 +1,97 @@
+package acmeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+// maxSignedBody limits the size of a signed request body
+const maxSignedBody = 1 << 20
+
+// IdentityHMAC is the kind of identity of requests signed with a shared
+// key
+const IdentityHMAC string = "hmac"
+
+// HMACAuthenticator checks requests signed with a shared key (see
+// client.SignRequest). Nonces are kept in the state store for twice the
+// allowed clock skew, so a signed request can't be replayed.
+type HMACAuthenticator struct {
+	keys    map[string][]byte
+	maxSkew time.Duration
+	store   state.Store
+}
+
+// NewHMACAuthenticator loads the keys from file, with a "<key ID>:<base64
+// key>" line per key
+func NewHMACAuthenticator(file string, maxSkew time.Duration, store state.Store) (*HMACAuthenticator, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kv := strings.SplitN(text, ":", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected <key ID>:<base64 key>", file, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kv[1]))
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("%s:%d: key must be base64 encoded and at least 16 bytes", file, line)
+		}
+		keys[kv[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &HMACAuthenticator{keys: keys, maxSkew: maxSkew, store: store}, nil
+}
+
+// Authenticate checks the signature of r and returns the key ID it was
+// signed with. The body of r is replaced, so it can be read again.
+func (a *HMACAuthenticator) Authenticate(r *http.Request, params *client.SignatureParams) (string, error) {
+	key, ok := a.keys[params.KeyID]
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", params.KeyID)
+	}
+
+	if err := checkTimestamp(params.Timestamp, a.maxSkew); err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := client.Signature(key, client.SigningString(r.Method, r.URL.EscapedPath(), params.Timestamp, params.Nonce, body))
+	if !hmac.Equal([]byte(expected), []byte(params.Signature)) {
+		return "", errors.New("signature mismatch")
+	}
+
+	// Only a valid signature uses up the nonce
+	if err := useNonce(a.store, params.KeyID+"/"+params.Nonce, params.Timestamp, a.maxSkew); err != nil {
+		return "", err
+	}
+	return params.KeyID, nil
+}
@@ -0,0 +1,200 @@
+package acmeproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+var testHMACKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestHMACAuthenticator returns an authenticator with the key "site-a"
+func newTestHMACAuthenticator(t *testing.T, store state.Store) *HMACAuthenticator {
+	f, err := ioutil.TempFile("", "acmeproxy-hmac-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# keys\nsite-a:%s\n", base64.StdEncoding.EncodeToString(testHMACKey))
+	f.Close()
+
+	a, err := NewHMACAuthenticator(f.Name(), 5*time.Minute, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// signedRequest returns a /present request signed by keyID at ts with nonce
+func signedRequest(keyID string, key []byte, ts time.Time, nonce string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/present", bytes.NewReader([]byte(body)))
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := client.Signature(key, client.SigningString(r.Method, r.URL.EscapedPath(), timestamp, nonce, []byte(body)))
+	r.Header.Set("Authorization", fmt.Sprintf("%s key=%s, ts=%s, nonce=%s, sig=%s", client.SignatureScheme, keyID, timestamp, nonce, sig))
+	return r
+}
+
+func authenticateHMAC(a *HMACAuthenticator, r *http.Request) (string, error) {
+	params, signed, err := client.ParseSignature(r.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	}
+	if !signed {
+		return "", fmt.Errorf("request isn't signed")
+	}
+	return a.Authenticate(r, params)
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	maxSkew := 5 * time.Minute
+	tests := []struct {
+		timestamp string
+		err       bool
+	}{
+		{timestamp: strconv.FormatInt(time.Now().Unix(), 10)},
+		{timestamp: strconv.FormatInt(time.Now().Add(-4*time.Minute).Unix(), 10)},
+		{timestamp: strconv.FormatInt(time.Now().Add(4*time.Minute).Unix(), 10)},
+		{timestamp: strconv.FormatInt(time.Now().Add(-6*time.Minute).Unix(), 10), err: true},
+		{timestamp: strconv.FormatInt(time.Now().Add(6*time.Minute).Unix(), 10), err: true},
+		{timestamp: "", err: true},
+		{timestamp: "yesterday", err: true},
+	}
+
+	for _, test := range tests {
+		err := checkTimestamp(test.timestamp, maxSkew)
+		if test.err && err == nil {
+			t.Errorf("%q: accepted, want an error", test.timestamp)
+		} else if !test.err && err != nil {
+			t.Errorf("%q: %v", test.timestamp, err)
+		}
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	store := state.NewMemoryStore()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	maxSkew := 100 * time.Millisecond
+
+	if err := useNonce(store, "site-a/n1", ts, maxSkew); err != nil {
+		t.Fatal(err)
+	}
+	if err := useNonce(store, "site-a/n1", ts, maxSkew); err == nil {
+		t.Fatal("replayed nonce accepted")
+	}
+	// Nonces are per key
+	if err := useNonce(store, "site-b/n1", ts, maxSkew); err != nil {
+		t.Fatalf("nonce of another key: %v", err)
+	}
+
+	// Nonces are forgotten after twice maxSkew, when their timestamp is
+	// rejected anyway
+	time.Sleep(3 * maxSkew)
+	if err := useNonce(store, "site-a/n1", ts, maxSkew); err != nil {
+		t.Fatalf("nonce kept after twice the skew: %v", err)
+	}
+}
+
+func TestHMACAuthenticate(t *testing.T) {
+	a := newTestHMACAuthenticator(t, state.NewMemoryStore())
+	now := time.Now()
+	body := `{"fqdn":"_acme-challenge.example.com.","value":"x"}`
+
+	tamperedBody := signedRequest("site-a", testHMACKey, now, "tampered", body)
+	tamperedBody.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"fqdn":"_acme-challenge.example.org.","value":"x"}`)))
+	tamperedPath := signedRequest("site-a", testHMACKey, now, "path", body)
+	tamperedPath.URL.Path = "/cleanup"
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		err  bool
+	}{
+		{name: "valid", req: signedRequest("site-a", testHMACKey, now, "n1", body)},
+		{name: "valid, small skew", req: signedRequest("site-a", testHMACKey, now.Add(-time.Minute), "n2", body)},
+		{name: "replayed", req: signedRequest("site-a", testHMACKey, now, "n1", body), err: true},
+		{name: "too old", req: signedRequest("site-a", testHMACKey, now.Add(-10*time.Minute), "n3", body), err: true},
+		{name: "from the future", req: signedRequest("site-a", testHMACKey, now.Add(10*time.Minute), "n4", body), err: true},
+		{name: "unknown key", req: signedRequest("site-b", testHMACKey, now, "n5", body), err: true},
+		{name: "wrong key", req: signedRequest("site-a", []byte("fedcba9876543210fedcba9876543210"), now, "n6", body), err: true},
+		{name: "tampered body", req: tamperedBody, err: true},
+		{name: "tampered path", req: tamperedPath, err: true},
+	}
+
+	for _, test := range tests {
+		keyID, err := authenticateHMAC(a, test.req)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: authenticated as %q, want an error", test.name, keyID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if keyID != "site-a" {
+			t.Errorf("%s: authenticated as %q, want %q", test.name, keyID, "site-a")
+		}
+	}
+}
+
+// TestHMACBodyReadable checks the body can be read again after the
+// signature was checked
+func TestHMACBodyReadable(t *testing.T) {
+	a := newTestHMACAuthenticator(t, state.NewMemoryStore())
+	body := `{"fqdn":"_acme-challenge.example.com.","value":"x"}`
+	r := signedRequest("site-a", testHMACKey, time.Now(), "n1", body)
+	if _, err := authenticateHMAC(a, r); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(r.Body); string(data) != body {
+		t.Fatalf("body after authentication: got %q, want %q", data, body)
+	}
+}
+
+// TestHMACFailedSignatureKeepsNonce checks an invalid signature doesn't use
+// up the nonce of a valid request
+func TestHMACFailedSignatureKeepsNonce(t *testing.T) {
+	a := newTestHMACAuthenticator(t, state.NewMemoryStore())
+	now := time.Now()
+	if _, err := authenticateHMAC(a, signedRequest("site-a", []byte("fedcba9876543210fedcba9876543210"), now, "n1", "")); err == nil {
+		t.Fatal("wrong key accepted")
+	}
+	if _, err := authenticateHMAC(a, signedRequest("site-a", testHMACKey, now, "n1", "")); err != nil {
+		t.Fatalf("nonce used up by an invalid signature: %v", err)
+	}
+}
+
+// TestHMACIdentity checks key IDs can't be mistaken for users with the
+// same name
+func TestHMACIdentity(t *testing.T) {
+	config := &Config{HMAC: newTestHMACAuthenticator(t, state.NewMemoryStore()), AdminUsers: []string{"site-a"}}
+	r := signedRequest("site-a", testHMACKey, time.Now(), "n1", "")
+	params, _, err := client.ParseSignature(r.Header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := authenticateSignature(r, params, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Owner() != "hmac:site-a" {
+		t.Fatalf("owner: got %q, want %q", id.Owner(), "hmac:site-a")
+	}
+	if requestIdentity(withIdentity(r, id), config).Admin {
+		t.Fatal("key site-a is admin as user site-a")
+	}
+
+	config.AdminUsers = []string{"hmac:site-a"}
+	if !requestIdentity(withIdentity(r, id), config).Admin {
+		t.Fatal("key site-a isn't admin as hmac:site-a")
+	}
+}
@@ -0,0 +1,94 @@
+package acmeproxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	auth "github.com/abbot/go-http-auth"
+)
+
+const (
+	IdentityUser string = "user"
+	IdentityIP   string = "ip"
+	IdentityUID  string = "uid"
+	IdentityJWT  string = "jwt"
+)
+
+// identity describes who made a request
+type identity struct {
+	Kind  string
+	Name  string
+	Admin bool
+	// Domains limits the domains the caller may request (on top of
+	// allowed-domains), nil means no limit
+	Domains []string
+}
+
+type identityKey struct{}
+
+// withIdentity stores the identity established by a bearer token in r
+func withIdentity(r *http.Request, id identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// Owner returns the key records are registered to for this identity
+func (id identity) Owner() string {
+	return id.Kind + ":" + id.Name
+}
+
+// requestIdentity returns the token subject, signing key or authenticated
+// user if there is one, the local user for requests on a unix socket, the client
+// IP otherwise
+func requestIdentity(r *http.Request, config *Config) identity {
+	if id, ok := r.Context().Value(identityKey{}).(identity); ok {
+		// Tokens and signing keys are listed by owner in admin-users, so
+		// they can't be mistaken for a user with the same name
+		id.Admin = contains(config.AdminUsers, id.Owner())
+		return id
+	}
+	if authInfo := auth.FromContext(r.Context()); authInfo != nil && authInfo.Authenticated {
+		return identity{
+			Kind:  IdentityUser,
+			Name:  authInfo.Username,
+			Admin: contains(config.AdminUsers, authInfo.Username),
+		}
+	}
+	if peer, ok := peerFromRequest(r); ok {
+		name := peer.Username()
+		return identity{
+			Kind:  IdentityUID,
+			Name:  name,
+			Admin: contains(config.AdminUsers, IdentityUID+":"+name),
+		}
+	}
+	return identity{Kind: IdentityIP, Name: clientIP(r)}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the identity may request domain
+func (id identity) Allowed(domain string) bool {
+	if id.Domains == nil {
+		return true
+	}
+	for _, d := range id.Domains {
+		if domainMatches(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatches reports whether domain is parent or one of its subdomains
+func domainMatches(domain, parent string) bool {
+	domain, parent = strings.ToLower(domain), strings.ToLower(parent)
+	return domain == parent || strings.HasSuffix(domain, "."+parent)
+}
@@ -0,0 +1,186 @@
+package acmeproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IPFilter decides which client IPs may use an action. Deny rules take
+// precedence over allow rules; when there are allow rules, all other IPs
+// are denied. Rules are IPs, CIDR networks (IPv4, IPv6 or IPv4-mapped
+// IPv6) or hostnames, which are resolved again by Resolve.
+type IPFilter struct {
+	allow []*ipRule
+	deny  []*ipRule
+}
+
+// ipRule is a single allow or deny entry
+type ipRule struct {
+	entry string
+	deny  bool
+	// host is set for hostname entries
+	host string
+
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+// NewIPFilter compiles the allow and deny entries
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	for _, entry := range allow {
+		rule, err := newIPRule(entry, false)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, rule)
+	}
+	for _, entry := range deny {
+		rule, err := newIPRule(entry, true)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, rule)
+	}
+	return f, nil
+}
+
+func newIPRule(entry string, deny bool) (*ipRule, error) {
+	entry = strings.TrimSpace(entry)
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("empty IP filter entry")
+	}
+	rule := &ipRule{entry: entry, deny: deny}
+
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		rule.nets = []*net.IPNet{normalizeIPNet(n)}
+		return rule, nil
+	}
+	if ip := parseIP(entry); ip != nil {
+		rule.nets = []*net.IPNet{hostIPNet(ip)}
+		return rule, nil
+	}
+
+	// Anything else is a hostname
+	rule.host = entry
+	rule.resolve()
+	return rule, nil
+}
+
+// resolve looks up the addresses of a hostname rule. When the lookup
+// fails the previous addresses are kept.
+func (r *ipRule) resolve() {
+	if len(r.host) == 0 {
+		return
+	}
+	addrs, err := net.LookupHost(r.host)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"prefix": "ipfilter",
+			"host":   r.host,
+			"error":  err.Error(),
+		}).Warning("Unable to resolve hostname in IP filter, keeping previous addresses")
+		return
+	}
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ip := parseIP(addr); ip != nil {
+			nets = append(nets, hostIPNet(ip))
+		}
+	}
+	r.mu.Lock()
+	r.nets = nets
+	r.mu.Unlock()
+}
+
+func (r *ipRule) contains(ip net.IP) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return containsIP(r.nets, ip)
+}
+
+func (r *ipRule) String() string {
+	if r.deny {
+		return "deny " + r.entry
+	}
+	return "allow " + r.entry
+}
+
+// Empty reports whether the filter has no rules, so every IP is allowed
+func (f *IPFilter) Empty() bool {
+	return f == nil || (len(f.allow) == 0 && len(f.deny) == 0)
+}
+
+// Allowed reports whether ip may pass, and the rule that decided it
+func (f *IPFilter) Allowed(ip string) (bool, string) {
+	if f.Empty() {
+		return true, "no rules"
+	}
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return false, "invalid client IP"
+	}
+	for _, rule := range f.deny {
+		if rule.contains(parsed) {
+			return false, rule.String()
+		}
+	}
+	for _, rule := range f.allow {
+		if rule.contains(parsed) {
+			return true, rule.String()
+		}
+	}
+	if len(f.allow) == 0 {
+		return true, "no deny rule matched"
+	}
+	return false, "no allow rule matched"
+}
+
+// Resolve looks up the hostnames in the filter again
+func (f *IPFilter) Resolve() {
+	if f == nil {
+		return
+	}
+	for _, rule := range append(append([]*ipRule{}, f.allow...), f.deny...) {
+		rule.resolve()
+	}
+}
+
+// parseIP parses an IP address, dropping an IPv6 zone and turning
+// IPv4-mapped IPv6 addresses into IPv4
+func parseIP(s string) net.IP {
+	if i := strings.LastIndex(s, "%"); i >= 0 {
+		s = s[:i]
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// hostIPNet returns the network containing only ip
+func hostIPNet(ip net.IP) *net.IPNet {
+	bits := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// normalizeIPNet turns an IPv4-mapped IPv6 network (::ffff:0:0/96 and
+// smaller) into the IPv4 network it maps, so it matches IPv4 clients
+func normalizeIPNet(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv6len && ones >= 96 {
+		if ip4 := n.IP.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+		}
+	}
+	return n
+}
@@ -0,0 +1,69 @@
+package acmeproxy
+
+import (
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunJobs starts the periodic jobs. Instances sharing the state store
+// take turns: each run of a job happens on only one of them.
+func RunJobs(config *Config) {
+	if config.RecordMaxAge > 0 {
+		go runJob(config.State, "expire-records", recordExpiryInterval(config.RecordMaxAge), func() error {
+			return expireRecords(config)
+		})
+	}
+}
+
+// runJob calls job every interval, when this instance claims the run
+func runJob(store state.Store, name string, interval time.Duration, job func() error) {
+	jlog := log.WithFields(log.Fields{
+		"prefix": "jobs",
+		"job":    name,
+	})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		claimed, err := state.ClaimJob(store, name, interval, now)
+		if err != nil {
+			jlog.WithField("error", err.Error()).Error("Unable to claim job")
+			continue
+		}
+		if !claimed {
+			jlog.Debug("Job already run by another instance")
+			continue
+		}
+		if err := job(); err != nil {
+			jlog.WithField("error", err.Error()).Error("Job failed")
+		}
+	}
+}
+
+// recordExpiryInterval checks for expired records ten times per maxAge,
+// but at most every minute and at least every hour
+func recordExpiryInterval(maxAge time.Duration) time.Duration {
+	interval := maxAge / 10
+	if interval < time.Minute {
+		return time.Minute
+	} else if interval > time.Hour {
+		return time.Hour
+	}
+	return interval
+}
+
+// expireRecords removes the TXT records that weren't cleaned up within
+// config.RecordMaxAge
+func expireRecords(config *Config) error {
+	expired, err := config.records.expire(config.Provider, config.RecordMaxAge)
+	for _, fqdn := range expired {
+		log.WithFields(log.Fields{
+			"prefix": "records",
+			"fqdn":   fqdn,
+			"maxAge": config.RecordMaxAge.String(),
+		}).Info("Removed TXT record that wasn't cleaned up")
+	}
+	return err
+}
@@ -0,0 +1,288 @@
+package acmeproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// DefaultDomainsClaim is the claim listing the domains a token may
+	// request certificates for
+	DefaultDomainsClaim string = "domains"
+
+	// jwksMinRefresh limits how often an unknown key ID makes us fetch
+	// the JWKS again
+	jwksMinRefresh = time.Minute
+)
+
+// jwtAlgorithms are the signature algorithms accepted for tokens; HMAC is
+// left out, the keys come from a public JWKS
+var jwtAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// JWTIssuer is an OpenID Connect provider (or other JWT issuer) whose
+// tokens are accepted
+type JWTIssuer struct {
+	// Issuer must match the iss claim
+	Issuer string
+	// JWKS is a file or URL with the signing keys. Without it the keys
+	// are found through the issuer's OpenID Connect discovery document.
+	JWKS string
+	// Audience lists the accepted audiences, one of them must be in the
+	// aud claim. Tokens are rejected when it is empty, as tokens the
+	// issuer minted for other services must not be accepted.
+	Audience []string
+	// DomainsClaim names the claim with the domains the caller may
+	// request, a list or a space or comma separated string
+	DomainsClaim string
+
+	keys *jwksCache
+}
+
+// JWTAuthenticator validates bearer tokens from the configured issuers
+type JWTAuthenticator struct {
+	issuers map[string]*JWTIssuer
+}
+
+// NewJWTAuthenticator returns an authenticator for issuers, fetching
+// their keys again every refresh
+func NewJWTAuthenticator(issuers []*JWTIssuer, refresh time.Duration) *JWTAuthenticator {
+	a := &JWTAuthenticator{issuers: make(map[string]*JWTIssuer)}
+	for _, issuer := range issuers {
+		if len(issuer.DomainsClaim) == 0 {
+			issuer.DomainsClaim = DefaultDomainsClaim
+		}
+		issuer.keys = &jwksCache{issuer: issuer, refresh: refresh}
+		a.issuers[issuer.Issuer] = issuer
+	}
+	return a
+}
+
+// Authenticate validates token and returns the identity of the caller,
+// limited to the domains in the token
+func (a *JWTAuthenticator) Authenticate(token string) (identity, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return identity{}, err
+	}
+	if len(tok.Headers) != 1 || !jwtAlgorithms[tok.Headers[0].Algorithm] {
+		return identity{}, errors.New("unsupported token signature algorithm")
+	}
+
+	// The issuer tells us which keys to verify the token with
+	var unverified jwt.Claims
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return identity{}, err
+	}
+	issuer, ok := a.issuers[unverified.Issuer]
+	if !ok {
+		return identity{}, fmt.Errorf("unknown token issuer %q", unverified.Issuer)
+	}
+
+	key, err := issuer.keys.key(tok.Headers[0].KeyID)
+	if err != nil {
+		return identity{}, err
+	}
+
+	var claims jwt.Claims
+	extra := make(map[string]interface{})
+	if err := tok.Claims(key, &claims, &extra); err != nil {
+		return identity{}, err
+	}
+	if claims.Expiry == nil {
+		return identity{}, errors.New("token has no expiry")
+	}
+	if err := claims.Validate(jwt.Expected{Issuer: issuer.Issuer, Time: time.Now()}); err != nil {
+		return identity{}, err
+	}
+	if !containsAudience(claims.Audience, issuer.Audience) {
+		return identity{}, errors.New("token audience not accepted")
+	}
+	if len(claims.Subject) == 0 {
+		return identity{}, errors.New("token has no subject")
+	}
+
+	domains, err := claimDomains(extra, issuer.DomainsClaim, claims.Subject)
+	if err != nil {
+		return identity{}, err
+	}
+	return identity{Kind: IdentityJWT, Name: claims.Subject, Domains: domains}, nil
+}
+
+func containsAudience(audience jwt.Audience, accepted []string) bool {
+	for _, a := range accepted {
+		if audience.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimDomains returns the domains listed in claim. A token without the
+// claim may not request any domain.
+func claimDomains(claims map[string]interface{}, claim string, subject string) ([]string, error) {
+	value, ok := claims[claim]
+	if claim == "sub" {
+		value, ok = subject, true
+	}
+	if !ok {
+		return []string{}, nil
+	}
+
+	var domains []string
+	switch v := value.(type) {
+	case string:
+		domains = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		for _, d := range v {
+			s, ok := d.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s claim", claim)
+			}
+			domains = append(domains, s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s claim", claim)
+	}
+
+	for i, d := range domains {
+		domains[i] = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+	}
+	return domains, nil
+}
+
+// jwksCache keeps the signing keys of an issuer, fetching them again
+// after refresh or when a token uses an unknown key ID
+type jwksCache struct {
+	issuer  *JWTIssuer
+	refresh time.Duration
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+func (c *jwksCache) key(kid string) (*jose.JSONWebKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := c.keys == nil || (c.refresh > 0 && time.Since(c.fetched) > c.refresh)
+	if !stale && c.find(kid) == nil && time.Since(c.fetched) > jwksMinRefresh {
+		// The issuer may have rotated its keys
+		stale = true
+	}
+	if stale {
+		keys, err := c.fetch()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"prefix": "jwt",
+				"issuer": c.issuer.Issuer,
+				"error":  err.Error(),
+			}).Error("Unable to fetch JWKS")
+			if c.keys == nil {
+				return nil, err
+			}
+			// Keep using the keys we have
+		} else {
+			c.keys, c.fetched = keys, time.Now()
+		}
+	}
+
+	if key := c.find(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown token key ID %q", kid)
+}
+
+// find returns the signing key with kid, or the only key when the token
+// has no key ID
+func (c *jwksCache) find(kid string) *jose.JSONWebKey {
+	if c.keys == nil {
+		return nil
+	}
+	if len(kid) == 0 && len(c.keys.Keys) == 1 {
+		return &c.keys.Keys[0]
+	}
+	for i, key := range c.keys.Keys {
+		if key.KeyID == kid && key.Use != "enc" {
+			return &c.keys.Keys[i]
+		}
+	}
+	return nil
+}
+
+func (c *jwksCache) fetch() (*jose.JSONWebKeySet, error) {
+	source := c.issuer.JWKS
+	if len(source) == 0 {
+		var err error
+		if source, err = discoverJWKS(c.issuer.Issuer); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := readSource(source)
+	if err != nil {
+		return nil, err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, keys); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %v", source, err)
+	}
+	log.WithFields(log.Fields{
+		"prefix": "jwt",
+		"issuer": c.issuer.Issuer,
+		"keys":   len(keys.Keys),
+	}).Debug("Fetched JWKS")
+	return keys, nil
+}
+
+// discoverJWKS finds the jwks_uri in the OpenID Connect discovery
+// document of issuer
+func discoverJWKS(issuer string) (string, error) {
+	data, err := readSource(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(data, &discovery); err != nil {
+		return "", err
+	}
+	if len(discovery.JWKSURI) == 0 {
+		return "", fmt.Errorf("no jwks_uri in the discovery document of %s", issuer)
+	}
+	return discovery.JWKSURI, nil
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// readSource reads a URL or a file
+func readSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return ioutil.ReadFile(source)
+	}
+	resp, err := jwksClient.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,238 @@
+package acmeproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksServer is a local stand-in for the JWKS endpoint of an issuer
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    jose.JSONWebKeySet
+	fetches int
+}
+
+func newJWKSServer() *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		json.NewEncoder(w).Encode(s.keys)
+	}))
+	return s
+}
+
+// rotate replaces the published keys
+func (s *jwksServer) rotate(keys ...*ecdsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys.Keys = nil
+	for i, key := range keys {
+		s.keys.Keys = append(s.keys.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: testKeyID(keys[i]), Algorithm: string(jose.ES256), Use: "sig"})
+	}
+}
+
+func testKeyID(key *ecdsa.PrivateKey) string {
+	return fmt.Sprintf("%x", key.PublicKey.X.Bytes()[:4])
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signToken returns a token signed with key, with claims and extra claims
+func signToken(t *testing.T, key *ecdsa.PrivateKey, claims jwt.Claims, extra map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: testKeyID(key)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(extra).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+const testIssuer = "https://issuer.example.com"
+
+func testClaims() jwt.Claims {
+	return jwt.Claims{
+		Issuer:   testIssuer,
+		Subject:  "repo:example/app",
+		Audience: jwt.Audience{"acmeproxy"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer()
+	defer server.Close()
+	server.rotate(key)
+
+	a := NewJWTAuthenticator([]*JWTIssuer{{Issuer: testIssuer, JWKS: server.URL, Audience: []string{"acmeproxy"}}}, time.Hour)
+	domains := map[string]interface{}{"domains": []string{"App.Example.com.", "api.example.com"}}
+
+	expired := testClaims()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-2 * time.Minute))
+	wrongAudience := testClaims()
+	wrongAudience.Audience = jwt.Audience{"other-service"}
+	noExpiry := testClaims()
+	noExpiry.Expiry = nil
+	otherIssuer := testClaims()
+	otherIssuer.Issuer = "https://other.example.com"
+
+	tests := []struct {
+		name    string
+		token   string
+		domains string
+		err     bool
+	}{
+		{name: "valid", token: signToken(t, key, testClaims(), domains), domains: "[app.example.com api.example.com]"},
+		{name: "string domains", token: signToken(t, key, testClaims(), map[string]interface{}{"domains": "a.example.com, b.example.com"}), domains: "[a.example.com b.example.com]"},
+		{name: "no domains claim", token: signToken(t, key, testClaims(), nil), domains: "[]"},
+		{name: "invalid domains claim", token: signToken(t, key, testClaims(), map[string]interface{}{"domains": 42}), err: true},
+		{name: "expired", token: signToken(t, key, expired, domains), err: true},
+		{name: "no expiry", token: signToken(t, key, noExpiry, domains), err: true},
+		{name: "wrong audience", token: signToken(t, key, wrongAudience, domains), err: true},
+		{name: "unknown issuer", token: signToken(t, key, otherIssuer, domains), err: true},
+		{name: "unknown key", token: signToken(t, newTestKey(t), testClaims(), domains), err: true},
+		{name: "garbage", token: "not.a.token", err: true},
+	}
+
+	for _, test := range tests {
+		id, err := a.Authenticate(test.token)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %+v, want an error", test.name, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if id.Kind != IdentityJWT || id.Name != "repo:example/app" || fmt.Sprint(id.Domains) != test.domains {
+			t.Errorf("%s: got %+v, want domains %s", test.name, id, test.domains)
+		}
+	}
+}
+
+func TestJWTNoAudience(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer()
+	defer server.Close()
+	server.rotate(key)
+
+	// An issuer without audience accepts no token at all
+	a := NewJWTAuthenticator([]*JWTIssuer{{Issuer: testIssuer, JWKS: server.URL}}, time.Hour)
+	if _, err := a.Authenticate(signToken(t, key, testClaims(), nil)); err == nil {
+		t.Fatal("token accepted without a configured audience")
+	}
+}
+
+func TestJWTDomainsFromSubject(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer()
+	defer server.Close()
+	server.rotate(key)
+
+	a := NewJWTAuthenticator([]*JWTIssuer{{Issuer: testIssuer, JWKS: server.URL, Audience: []string{"acmeproxy"}, DomainsClaim: "sub"}}, time.Hour)
+	claims := testClaims()
+	claims.Subject = "host.example.com"
+	id, err := a.Authenticate(signToken(t, key, claims, map[string]interface{}{"domains": "other.example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(id.Domains) != "[host.example.com]" {
+		t.Fatalf("domains from sub: got %v", id.Domains)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	server := newJWKSServer()
+	defer server.Close()
+	server.rotate(oldKey)
+
+	issuer := &JWTIssuer{Issuer: testIssuer, JWKS: server.URL, Audience: []string{"acmeproxy"}}
+	a := NewJWTAuthenticator([]*JWTIssuer{issuer}, time.Hour)
+
+	if _, err := a.Authenticate(signToken(t, oldKey, testClaims(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(signToken(t, oldKey, testClaims(), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if server.fetches != 1 {
+		t.Fatalf("JWKS fetched %d times for the same key, want once", server.fetches)
+	}
+
+	server.rotate(oldKey, newKey)
+
+	// Unknown key IDs don't make us fetch the JWKS more than once a minute
+	if _, err := a.Authenticate(signToken(t, newKey, testClaims(), nil)); err == nil {
+		t.Fatal("token with a new key accepted without fetching the JWKS")
+	}
+	if server.fetches != 1 {
+		t.Fatalf("JWKS fetched %d times within a minute", server.fetches)
+	}
+
+	issuer.keys.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	if _, err := a.Authenticate(signToken(t, newKey, testClaims(), nil)); err != nil {
+		t.Fatalf("token with a rotated key: %v", err)
+	}
+	if server.fetches != 2 {
+		t.Fatalf("JWKS fetched %d times after the rotation, want twice", server.fetches)
+	}
+
+	// Once the old key is gone from the JWKS, its tokens are rejected
+	server.rotate(newKey)
+	issuer.keys.fetched = time.Now().Add(-2 * time.Hour)
+	if _, err := a.Authenticate(signToken(t, oldKey, testClaims(), nil)); err == nil {
+		t.Fatal("token with a removed key accepted")
+	}
+	if _, err := a.Authenticate(signToken(t, newKey, testClaims(), nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTKeepKeysWhenFetchFails(t *testing.T) {
+	key := newTestKey(t)
+	server := newJWKSServer()
+	server.rotate(key)
+
+	issuer := &JWTIssuer{Issuer: testIssuer, JWKS: server.URL, Audience: []string{"acmeproxy"}}
+	a := NewJWTAuthenticator([]*JWTIssuer{issuer}, time.Hour)
+	if _, err := a.Authenticate(signToken(t, key, testClaims(), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	issuer.keys.fetched = time.Now().Add(-2 * time.Hour)
+	if _, err := a.Authenticate(signToken(t, key, testClaims(), nil)); err != nil {
+		t.Fatalf("cached keys not used while the JWKS is unreachable: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package acmeproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	NetworkTCP     string = "tcp"
+	NetworkUnix    string = "unix"
+	NetworkSystemd string = "systemd"
+)
+
+// Listener is a socket acmeproxy serves requests on
+type Listener struct {
+	net.Listener
+	// Name describes the listener in logs
+	Name string
+	// TLSConfig is set when requests on this listener use HTTPS
+	TLSConfig *tls.Config
+}
+
+// ListenAddress is a single entry of the listen setting, e.g.
+// "127.0.0.1:9095 ssl=none", "unix:/run/acmeproxy.sock mode=0660 owner=www-data"
+// or "systemd:acmeproxy"
+type ListenAddress struct {
+	Network string
+	Address string
+	Options map[string]string
+}
+
+// ParseListenAddress parses a listen entry: an address followed by
+// optional key=value options
+func ParseListenAddress(s string) (*ListenAddress, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty listen address")
+	}
+
+	la := &ListenAddress{Options: make(map[string]string)}
+	switch {
+	case strings.HasPrefix(fields[0], "unix:"):
+		la.Network = NetworkUnix
+		la.Address = strings.TrimPrefix(fields[0], "unix:")
+	case fields[0] == NetworkSystemd || strings.HasPrefix(fields[0], "systemd:"):
+		la.Network = NetworkSystemd
+		la.Address = strings.TrimPrefix(strings.TrimPrefix(fields[0], NetworkSystemd), ":")
+	default:
+		la.Network = NetworkTCP
+		la.Address = strings.TrimPrefix(fields[0], "tcp:")
+		if _, _, err := net.SplitHostPort(la.Address); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", fields[0], err)
+		}
+	}
+
+	if la.Network == NetworkUnix && la.Address == "" {
+		return nil, fmt.Errorf("invalid listen address %q: missing socket path", fields[0])
+	}
+
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid listen option %q for %s", option, fields[0])
+		}
+		la.Options[kv[0]] = kv[1]
+	}
+
+	return la, nil
+}
+
+// String returns the address as used in logs
+func (la *ListenAddress) String() string {
+	if la.Address == "" {
+		return la.Network
+	}
+	return la.Network + ":" + la.Address
+}
+
+// Listen opens the sockets for la. Systemd entries can return multiple
+// inherited sockets.
+func (la *ListenAddress) Listen() ([]net.Listener, error) {
+	switch la.Network {
+	case NetworkUnix:
+		l, err := listenUnix(la.Address, la.Options)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case NetworkSystemd:
+		return systemdListeners(la.Address)
+	}
+
+	addresses, err := resolveAddress(la.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		l, err := net.Listen(la.Network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// resolveAddress returns a host:port address for every IP a hostname
+// resolves to. IP addresses and an empty host (all interfaces) are
+// returned as they are.
+func resolveAddress(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil || strings.Contains(host, "%") {
+		return []string{address}, nil
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("can't find IP for interface %s - not in DNS? (%v)", host, err)
+	}
+
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+	return addresses, nil
+}
+
+// listenUnix creates a unix socket at path, applying the mode, owner and
+// group options
+func listenUnix(path string, options map[string]string) (net.Listener, error) {
+	// Remove a stale socket from a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(NetworkUnix, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode, ok := options["mode"]; ok {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid mode %q for %s: %v", mode, path, err)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	uid, gid := -1, -1
+	if owner, ok := options["owner"]; ok {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group, ok := options["group"]; ok {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
@@ -0,0 +1,153 @@
+package acmeproxy
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+const (
+	BanIP   string = "ip"
+	BanUser string = "user"
+)
+
+// Ban is a temporary ban of an IP or username after too many failed
+// authentication attempts
+type Ban struct {
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Until    time.Time `json:"until"`
+	Failures int64     `json:"failures"`
+}
+
+// Lockout tracks failed authentication attempts per IP and per username
+// in the state store, so bans are shared between instances. After
+// Threshold failures within Window the IP or username is banned for
+// BanTime, doubling for every ban within MaxBanTime up to MaxBanTime.
+type Lockout struct {
+	Threshold  int64
+	Window     time.Duration
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+
+	store state.Store
+}
+
+// NewLockout returns a Lockout keeping its counters in store
+func NewLockout(store state.Store, threshold int64, window, banTime, maxBanTime time.Duration) *Lockout {
+	if maxBanTime < banTime {
+		maxBanTime = banTime
+	}
+	return &Lockout{
+		Threshold:  threshold,
+		Window:     window,
+		BanTime:    banTime,
+		MaxBanTime: maxBanTime,
+		store:      store,
+	}
+}
+
+func banKey(kind, name string) string {
+	return "bans/" + kind + "/" + name
+}
+
+func failuresKey(kind, name string) string {
+	return "auth-failures/" + kind + "/" + name
+}
+
+func strikesKey(kind, name string) string {
+	return "ban-strikes/" + kind + "/" + name
+}
+
+// Banned returns the ban for name, or nil if it isn't banned
+func (l *Lockout) Banned(kind, name string) (*Ban, error) {
+	data, err := l.store.Get(banKey(kind, name))
+	if err == state.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ban := &Ban{}
+	if err := json.Unmarshal(data, ban); err != nil {
+		return nil, err
+	}
+	if time.Now().After(ban.Until) {
+		return nil, nil
+	}
+	return ban, nil
+}
+
+// Fail records a failed attempt for name and returns the ban when it
+// crossed the threshold
+func (l *Lockout) Fail(kind, name string) (*Ban, error) {
+	failures, err := l.store.Incr(failuresKey(kind, name), l.Window)
+	if err != nil || failures < l.Threshold {
+		return nil, err
+	}
+
+	// Every ban within MaxBanTime doubles the ban time
+	strikes, err := l.store.Incr(strikesKey(kind, name), l.MaxBanTime)
+	if err != nil {
+		return nil, err
+	}
+	banTime := l.BanTime
+	for i := int64(1); i < strikes && banTime < l.MaxBanTime; i++ {
+		banTime *= 2
+	}
+	if banTime > l.MaxBanTime {
+		banTime = l.MaxBanTime
+	}
+
+	ban := &Ban{Kind: kind, Name: name, Until: time.Now().Add(banTime).Round(time.Second), Failures: failures}
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.store.Put(banKey(kind, name), data, banTime); err != nil {
+		return nil, err
+	}
+	// Start counting again after the ban
+	return ban, l.store.Delete(failuresKey(kind, name))
+}
+
+// Succeed resets the failed attempts for name
+func (l *Lockout) Succeed(kind, name string) error {
+	return l.store.Delete(failuresKey(kind, name))
+}
+
+// Bans returns all current bans
+func (l *Lockout) Bans() ([]Ban, error) {
+	keys, err := l.store.List("bans/")
+	if err != nil {
+		return nil, err
+	}
+	bans := []Ban{}
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, "bans/"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ban, err := l.Banned(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if ban != nil {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans, nil
+}
+
+// Clear lifts the ban on name and resets its failed attempts
+func (l *Lockout) Clear(kind, name string) error {
+	for _, key := range []string{banKey(kind, name), failuresKey(kind, name), strikesKey(kind, name)} {
+		if err := l.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
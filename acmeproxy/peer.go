@@ -0,0 +1,60 @@
+package acmeproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// peerCredentials are the credentials of the process on the other end of
+// a unix socket
+type peerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// Username returns the name of the peer's user, or its uid if the user
+// can't be looked up
+func (p *peerCredentials) Username() string {
+	uid := strconv.FormatUint(uint64(p.UID), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+type peerKey struct{}
+
+// ConnContext adds the peer credentials of unix socket connections to the
+// context of the requests made on them. It's meant to be used as
+// http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	peer, err := getPeerCredentials(uc)
+	if err != nil {
+		log.WithField("error", err.Error()).Warning("Failed to get peer credentials")
+		return ctx
+	}
+	return context.WithValue(ctx, peerKey{}, peer)
+}
+
+// peerFromRequest returns the peer credentials of requests received on a
+// unix socket
+func peerFromRequest(r *http.Request) (*peerCredentials, bool) {
+	peer, ok := r.Context().Value(peerKey{}).(*peerCredentials)
+	return peer, ok
+}
+
+// peerAllowed reports whether the peer is listed in allowed, either by
+// name or by uid
+func peerAllowed(peer *peerCredentials, allowed []string) bool {
+	return contains(allowed, strconv.FormatUint(uint64(peer.UID), 10)) || contains(allowed, peer.Username())
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package acmeproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCredentials is only supported on Linux
+func getPeerCredentials(c *net.UnixConn) (*peerCredentials, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,194 @@
+package acmeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyHeaderTimeout is how long a trusted upstream gets to send the
+// PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+var (
+	// proxyV1Prefix starts every PROXY protocol v1 header
+	proxyV1Prefix = []byte("PROXY ")
+	// proxyV2Signature starts every PROXY protocol v2 header
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtocolListener reads PROXY protocol (v1 and v2) headers sent by
+// trusted upstreams (e.g. HAProxy in TCP mode), so RemoteAddr returns the
+// address of the original client. Connections from other addresses are
+// used as they are. It has to wrap the plain listener, below TLS.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener wraps l to accept PROXY protocol headers from
+// the trusted networks
+func NewProxyProtocolListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(l.trusted, addr.IP) {
+		return c, nil
+	}
+	// The header is read on first use, in the connection's own goroutine
+	return &proxyConn{Conn: c, reader: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection from a trusted upstream that can start with
+// a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY protocol header, if there is one
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	switch {
+	case first[0] == 'P' && c.hasPrefix(proxyV1Prefix):
+		c.remoteAddr, c.err = readProxyV1(c.reader)
+	case first[0] == proxyV2Signature[0] && c.hasPrefix(proxyV2Signature):
+		c.remoteAddr, c.err = readProxyV2(c.reader)
+	default:
+		// No header, e.g. a health check by the load balancer
+		return
+	}
+
+	if c.err != nil {
+		log.WithFields(log.Fields{
+			"upstream": c.Conn.RemoteAddr().String(),
+			"error":    c.err.Error(),
+		}).Warning("Invalid PROXY protocol header")
+		c.Conn.Close()
+	}
+}
+
+// hasPrefix reports whether the connection starts with prefix
+func (c *proxyConn) hasPrefix(prefix []byte) bool {
+	b, err := c.reader.Peek(len(prefix))
+	return err == nil && bytes.Equal(b, prefix)
+}
+
+// readProxyV1 reads a v1 header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("not a v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads a binary v2 header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("not a v2 header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command: health checks by the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	// Only TCP (stream) over IPv4 or IPv6 carries a client address we use
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("v2 header too short for IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("v2 header too short for IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
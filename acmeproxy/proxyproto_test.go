@@ -0,0 +1,161 @@
+package acmeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", addr: "192.0.2.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", addr: "[2001:db8::1]:56324"},
+		// UNKNOWN keeps the address of the connection
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		// Truncated
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2", err: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", err: true},
+		{header: "", err: true},
+		// Over-long: the header is at most 107 bytes
+		{header: "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", err: true},
+		{header: "PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.x 192.0.2.2 56324 443\r\n", err: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n", err: true},
+		{header: "GET / HTTP/1.1\r\n", err: true},
+	}
+
+	for _, test := range tests {
+		addr, err := readProxyV1(bufio.NewReader(strings.NewReader(test.header)))
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %v, want an error", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+		} else if got := addrString(addr); got != test.addr {
+			t.Errorf("%q: got %q, want %q", test.header, got, test.addr)
+		}
+	}
+}
+
+// proxyV2Header builds a v2 header with command (0 LOCAL, 1 PROXY),
+// family/protocol and payload
+func proxyV2Header(command byte, family byte, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x20 | command)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// proxyV2Addresses returns the address payload for src and dst
+func proxyV2Addresses(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	var b bytes.Buffer
+	b.Write(src)
+	b.Write(dst)
+	binary.Write(&b, binary.BigEndian, srcPort)
+	binary.Write(&b, binary.BigEndian, dstPort)
+	return b.Bytes()
+}
+
+func TestReadProxyV2(t *testing.T) {
+	ipv4 := proxyV2Addresses(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 56324, 443)
+	ipv6 := proxyV2Addresses(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{name: "IPv4", header: proxyV2Header(1, 0x11, ipv4), addr: "192.0.2.1:56324"},
+		{name: "IPv6", header: proxyV2Header(1, 0x21, ipv6), addr: "[2001:db8::1]:56324"},
+		// TLVs after the addresses are skipped
+		{name: "IPv4 with TLVs", header: proxyV2Header(1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xff)), addr: "192.0.2.1:56324"},
+		// LOCAL (health checks) and UNSPEC keep the address of the connection
+		{name: "LOCAL", header: proxyV2Header(0, 0x00, nil)},
+		{name: "LOCAL with addresses", header: proxyV2Header(0, 0x11, ipv4)},
+		{name: "UNSPEC", header: proxyV2Header(1, 0x00, nil)},
+		{name: "UDP", header: proxyV2Header(1, 0x12, ipv4)},
+		{name: "truncated signature", header: proxyV2Signature[:8], err: true},
+		{name: "truncated header", header: proxyV2Header(1, 0x11, ipv4)[:14], err: true},
+		{name: "truncated payload", header: proxyV2Header(1, 0x11, ipv4)[:20], err: true},
+		{name: "IPv4 payload too short", header: proxyV2Header(1, 0x11, ipv4[:8]), err: true},
+		{name: "IPv6 payload too short", header: proxyV2Header(1, 0x21, ipv4), err: true},
+		{name: "version 1", header: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), err: true},
+	}
+
+	for _, test := range tests {
+		addr, err := readProxyV2(bufio.NewReader(bytes.NewReader(test.header)))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got := addrString(addr); got != test.addr {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.addr)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{name: "v1", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), addr: "192.0.2.1:56324"},
+		{name: "v2", header: proxyV2Header(1, 0x11, proxyV2Addresses(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 56324, 443)), addr: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", header: proxyV2Header(0, 0x00, nil), addr: "pipe"},
+		{name: "no header", addr: "pipe"},
+		{name: "invalid v1", header: []byte("PROXY TCP4 nonsense\r\n"), err: true},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(test.header, "GET / HTTP/1.1\r\n"...))
+			client.Close()
+		}()
+
+		c := &proxyConn{Conn: server, reader: bufio.NewReader(server)}
+		if got := c.RemoteAddr().String(); !test.err && got != test.addr {
+			t.Errorf("%s: remote address %q, want %q", test.name, got, test.addr)
+		}
+
+		data, err := ioutil.ReadAll(c)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: read %q, want an error", test.name, data)
+			}
+		} else if string(data) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: read %q, %v after the header", test.name, data, err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package acmeproxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// QuotaNames limits the distinct names an owner requests per window
+	QuotaNames string = "names"
+	// QuotaPresents limits the presents per base domain per window
+	QuotaPresents string = "presents"
+)
+
+// Quota allows Limit per Window, zero Limit means no limit
+type Quota struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// QuotaUsage is the use of a quota by an owner (QuotaNames) or base
+// domain (QuotaPresents) in the current window
+type QuotaUsage struct {
+	Quota   string    `json:"quota"`
+	Subject string    `json:"subject"`
+	Used    int64     `json:"used"`
+	Limit   int64     `json:"limit"`
+	Reset   time.Time `json:"reset"`
+}
+
+// QuotaExceededError is returned when a request doesn't fit in a quota
+type QuotaExceededError struct {
+	QuotaUsage
+}
+
+func (e *QuotaExceededError) Error() string {
+	return "quota exceeded: " + e.describe()
+}
+
+func (e *QuotaExceededError) describe() string {
+	what := "presents for " + e.Subject
+	if e.Quota == QuotaNames {
+		what = "distinct names for " + e.Subject
+	}
+	return fmt.Sprintf("at most %d %s, resets at %s", e.Limit, what, e.Reset.Format(time.RFC3339))
+}
+
+func quotaExceeded(quota, subject string, used, limit int64, reset time.Time) error {
+	return &QuotaExceededError{QuotaUsage{Quota: quota, Subject: subject, Used: used, Limit: limit, Reset: reset}}
+}
+
+// Quotas keeps long term counters in the state store, so they survive
+// restarts and are shared between instances. The counters are kept per
+// fixed window (see time.Truncate: days start at midnight UTC, weeks on
+// Monday), so every window resets at a known time.
+type Quotas struct {
+	// Names limits the distinct names per owner
+	Names Quota
+	// Presents limits the presents per base domain (the registered
+	// domain, like Let's Encrypt counts them)
+	Presents Quota
+
+	store state.Store
+}
+
+// NewQuotas returns Quotas counting in store
+func NewQuotas(store state.Store, names, presents Quota) *Quotas {
+	return &Quotas{Names: names, Presents: presents, store: store}
+}
+
+// window returns the start of the current window of q and when it resets
+func (q Quota) window() (string, time.Time) {
+	start := time.Now().Truncate(q.Window)
+	return strconv.FormatInt(start.Unix(), 10), start.Add(q.Window)
+}
+
+func namesKey(start, owner string) string {
+	return "quota-names/" + start + "/" + owner
+}
+
+func nameSeenKey(start, name, owner string) string {
+	return "quota-names-seen/" + start + "/" + name + "/" + owner
+}
+
+func presentsKey(start, domain string) string {
+	return "quota-presents/" + start + "/" + domain
+}
+
+// BaseDomain returns the registered domain of domain, e.g. example.co.uk
+// for www.example.co.uk
+func BaseDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if base, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return base
+	}
+	return domain
+}
+
+// QuotaReservation is a present that fits in the quotas. The quotas of
+// its owner and base domain stay locked until Release, so presents that
+// run at the same time can't overrun them.
+type QuotaReservation struct {
+	q             *Quotas
+	owner         string
+	name          string
+	base          string
+	namesStart    string
+	presentsStart string
+	newName       bool
+	unlock        []func()
+}
+
+// Reserve checks that a present of name by owner fits in the quotas, or
+// returns a QuotaExceededError when it doesn't. Nothing is counted until
+// Charge is called, so a present that fails doesn't use up the quotas.
+// Release must be called when the present is done.
+func (q *Quotas) Reserve(owner, name string) (*QuotaReservation, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	r := &QuotaReservation{q: q, owner: owner, name: name, base: BaseDomain(strings.TrimPrefix(name, "*."))}
+
+	// Owners are always locked before base domains
+	for _, lock := range []string{"quota/owner/" + r.owner, "quota/domain/" + r.base} {
+		unlock, err := q.store.Lock(lock)
+		if err != nil {
+			r.Release()
+			return nil, err
+		}
+		r.unlock = append(r.unlock, unlock)
+	}
+
+	if err := r.check(); err != nil {
+		r.Release()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *QuotaReservation) check() error {
+	q := r.q
+	if q.Names.Limit > 0 {
+		var reset time.Time
+		r.namesStart, reset = q.Names.window()
+		_, err := q.store.Get(nameSeenKey(r.namesStart, r.name, r.owner))
+		if err != nil && err != state.ErrNotFound {
+			return err
+		}
+		// Names requested before in this window are free
+		if r.newName = err == state.ErrNotFound; r.newName {
+			used, err := q.count(namesKey(r.namesStart, r.owner))
+			if err != nil {
+				return err
+			}
+			if used >= q.Names.Limit {
+				return quotaExceeded(QuotaNames, r.owner, used, q.Names.Limit, reset)
+			}
+		}
+	}
+	if q.Presents.Limit > 0 {
+		var reset time.Time
+		r.presentsStart, reset = q.Presents.window()
+		used, err := q.count(presentsKey(r.presentsStart, r.base))
+		if err != nil {
+			return err
+		}
+		if used >= q.Presents.Limit {
+			return quotaExceeded(QuotaPresents, r.base, used, q.Presents.Limit, reset)
+		}
+	}
+	return nil
+}
+
+// Charge counts the present, call it once the record was presented
+func (r *QuotaReservation) Charge() error {
+	q := r.q
+	if r.newName {
+		if err := q.store.Put(nameSeenKey(r.namesStart, r.name, r.owner), []byte{}, q.Names.Window); err != nil {
+			return err
+		}
+		if _, err := q.store.Incr(namesKey(r.namesStart, r.owner), q.Names.Window); err != nil {
+			return err
+		}
+	}
+	if q.Presents.Limit > 0 {
+		if _, err := q.store.Incr(presentsKey(r.presentsStart, r.base), q.Presents.Window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release unlocks the quotas of the reservation
+func (r *QuotaReservation) Release() {
+	for i := len(r.unlock) - 1; i >= 0; i-- {
+		r.unlock[i]()
+	}
+	r.unlock = nil
+}
+
+func (q *Quotas) count(key string) (int64, error) {
+	data, err := q.store.Get(key)
+	if err == state.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// Usage returns the use of the quotas in their current windows
+func (q *Quotas) Usage() ([]QuotaUsage, error) {
+	usage := []QuotaUsage{}
+	for _, quota := range []struct {
+		name   string
+		prefix string
+		quota  Quota
+	}{
+		{QuotaNames, "quota-names/", q.Names},
+		{QuotaPresents, "quota-presents/", q.Presents},
+	} {
+		if quota.quota.Limit <= 0 {
+			continue
+		}
+		start, reset := quota.quota.window()
+		keys, err := q.store.List(quota.prefix + start + "/")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			used, err := q.count(key)
+			if err != nil {
+				return nil, err
+			}
+			usage = append(usage, QuotaUsage{
+				Quota:   quota.name,
+				Subject: strings.TrimPrefix(key, quota.prefix+start+"/"),
+				Used:    used,
+				Limit:   quota.quota.Limit,
+				Reset:   reset,
+			})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Quota != usage[j].Quota {
+			return usage[i].Quota < usage[j].Quota
+		}
+		return usage[i].Subject < usage[j].Subject
+	})
+	return usage, nil
+}
@@ -0,0 +1,123 @@
+package acmeproxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+func TestQuotaReserve(t *testing.T) {
+	q := NewQuotas(state.NewMemoryStore(), Quota{Limit: 2, Window: time.Hour}, Quota{Limit: 3, Window: time.Hour})
+
+	use := func(owner, name string, charge bool) error {
+		r, err := q.Reserve(owner, name)
+		if err != nil {
+			return err
+		}
+		defer r.Release()
+		if charge {
+			return r.Charge()
+		}
+		return nil
+	}
+
+	// Reservations that aren't charged don't count
+	for i := 0; i < 5; i++ {
+		if err := use("user:alice", "a.example.com", false); err != nil {
+			t.Fatalf("uncharged reservation %d: %v", i, err)
+		}
+	}
+
+	if err := use("user:alice", "a.example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	// The same name again is free
+	if err := use("user:alice", "A.example.com.", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := use("user:alice", "*.a.example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := use("user:alice", "b.example.com", true).(*QuotaExceededError); !ok || err.Quota != QuotaNames {
+		t.Fatalf("third name: got %v, want the names quota exceeded", err)
+	}
+	if err, ok := use("user:bob", "c.example.com", true).(*QuotaExceededError); !ok || err.Quota != QuotaPresents || err.Subject != "example.com" {
+		t.Fatalf("fourth present for example.com: got %v, want the presents quota exceeded", err)
+	}
+	if err := use("user:bob", "example.org", true); err != nil {
+		t.Fatalf("present for another base domain: %v", err)
+	}
+}
+
+// TestQuotaReserveConcurrent checks reservations that overlap can't
+// overrun a quota
+func TestQuotaReserveConcurrent(t *testing.T) {
+	q := NewQuotas(state.NewMemoryStore(), Quota{}, Quota{Limit: 1, Window: time.Hour})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	charged := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := q.Reserve("user:alice", "example.com")
+			if err != nil {
+				return
+			}
+			defer r.Release()
+			time.Sleep(10 * time.Millisecond)
+			if err := r.Charge(); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			charged++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if charged != 1 {
+		t.Fatalf("%d presents charged, want 1", charged)
+	}
+}
+
+// TestQuotaProviderFailure checks presents the provider fails don't use up
+// the quota
+func TestQuotaProviderFailure(t *testing.T) {
+	provider := newFakeProvider()
+	config := &Config{
+		AllowedDomains: []string{"example.com"},
+		Provider:       provider,
+		Quotas:         NewQuotas(state.NewMemoryStore(), Quota{}, Quota{Limit: 1, Window: time.Hour}),
+		records:        newRecordStore(state.NewMemoryStore()),
+	}
+	h := ActionHandler(ActionPresent, config)
+
+	present := func(value string) int {
+		r := httptest.NewRequest(http.MethodPost, "/present", bytes.NewReader([]byte(`{"fqdn":"_acme-challenge.example.com.","value":"`+value+`"}`)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	provider.fail = true
+	for i := 0; i < 3; i++ {
+		if code := present("x"); code != http.StatusBadGateway {
+			t.Fatalf("present with a failing provider: got status %d, want %d", code, http.StatusBadGateway)
+		}
+	}
+
+	provider.fail = false
+	if code := present("x"); code != http.StatusOK {
+		t.Fatalf("present after provider failures: got status %d, want %d", code, http.StatusOK)
+	}
+	if code := present("y"); code != http.StatusTooManyRequests {
+		t.Fatalf("present over the quota: got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
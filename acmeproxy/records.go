@@ -0,0 +1,301 @@
+package acmeproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+// errNotOwner is returned when cleaning up a value presented by someone else
+var errNotOwner = errors.New("TXT record value is owned by another client")
+
+// record is a single TXT value for an fqdn, together with everything
+// needed to remove it from the provider again
+type record struct {
+	FQDN    string
+	Value   string
+	Mode    string
+	Domain  string
+	Token   string
+	KeyAuth string
+	// Zone is the allowed domain the record was presented for, whose
+	// lock serializes changes to it
+	Zone string
+	// Wildcard tells the record was requested for a wildcard certificate
+	Wildcard bool
+	// Presented is the time of the last present of the value
+	Presented time.Time
+	// Owners counts the outstanding presents per owner
+	Owners map[string]int
+}
+
+// recordSet holds all values that were presented for a single fqdn.
+// Released values are no longer referenced by anyone, but are kept in
+// DNS until the last live value for the fqdn has been cleaned up.
+type recordSet struct {
+	Live     map[string]*record
+	Released map[string]*record
+}
+
+// recordStore keeps track of the TXT values (and their owners) that
+// acmeproxy has presented, so that a cleanup only removes records that
+// no other order still needs. Records are kept in the state store, and
+// all provider operations for a zone are serialized with a lock in the
+// state store, so several instances can share the work.
+type recordStore struct {
+	store state.Store
+}
+
+func newRecordStore(store state.Store) *recordStore {
+	return &recordStore{store: store}
+}
+
+const recordPrefix = "records/"
+
+func recordKey(fqdn string) string {
+	return recordPrefix + fqdn
+}
+
+func (s *recordStore) load(fqdn string) (*recordSet, error) {
+	rs := &recordSet{Live: make(map[string]*record), Released: make(map[string]*record)}
+	data, err := s.store.Get(recordKey(fqdn))
+	if err == state.ErrNotFound {
+		return rs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (s *recordStore) save(fqdn string, rs *recordSet) error {
+	if len(rs.Live) == 0 && len(rs.Released) == 0 {
+		return s.store.Delete(recordKey(fqdn))
+	}
+	data, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(recordKey(fqdn), data, 0)
+}
+
+// present adds a reference for owner to rec and creates the TXT record
+// at the provider if the value is not in DNS yet
+func (s *recordStore) present(provider challenge.Provider, zone string, owner string, rec record) error {
+	unlock, err := s.store.Lock("zone/" + zone)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rs, err := s.load(rec.FQDN)
+	if err != nil {
+		return err
+	}
+
+	existing, live := rs.Live[rec.Value]
+	if !live {
+		existing, live = rs.Released[rec.Value]
+		if live {
+			// Still in DNS, just waiting for removal
+			delete(rs.Released, rec.Value)
+			rs.Live[rec.Value] = existing
+		}
+	}
+
+	if !live {
+		if err := createRecord(provider, rec); err != nil {
+			return err
+		}
+		existing = &rec
+		rs.Live[rec.Value] = existing
+	}
+
+	existing.Zone = zone
+	existing.Presented = time.Now()
+
+	if existing.Owners == nil {
+		existing.Owners = make(map[string]int)
+	}
+	existing.Owners[owner]++
+	return s.save(rec.FQDN, rs)
+}
+
+// cleanup drops the reference owner holds on rec. The TXT values for the
+// fqdn are only removed from the provider once no live value is left.
+// Values presented by someone else are only released when force is set,
+// otherwise errNotOwner is returned. It returns the number of values that
+// are still live for the fqdn.
+func (s *recordStore) cleanup(provider challenge.Provider, zone string, owner string, force bool, rec record) (int, error) {
+	unlock, err := s.store.Lock("zone/" + zone)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	rs, err := s.load(rec.FQDN)
+	if err != nil {
+		return 0, err
+	}
+
+	if existing, ok := rs.Live[rec.Value]; ok {
+		if existing.Owners[owner] > 0 {
+			existing.Owners[owner]--
+			if existing.Owners[owner] == 0 {
+				delete(existing.Owners, owner)
+			}
+		} else if force {
+			existing.Owners = make(map[string]int)
+		} else {
+			return len(rs.Live), errNotOwner
+		}
+		if len(existing.Owners) == 0 {
+			delete(rs.Live, rec.Value)
+			rs.Released[rec.Value] = existing
+		}
+	} else if _, ok := rs.Released[rec.Value]; !ok && len(rs.Live) == 0 {
+		// Not presented through us, but the caller wants it gone. It is
+		// left alone while other values are live: released values must
+		// be in DNS, and removing it could take the live values with it.
+		released := rec
+		rs.Released[rec.Value] = &released
+	}
+
+	err = s.removeReleased(provider, rs)
+	if saveErr := s.save(rec.FQDN, rs); err == nil {
+		err = saveErr
+	}
+	return len(rs.Live), err
+}
+
+// removeReleased removes the released values from the provider once no
+// live value is left for their fqdn
+func (s *recordStore) removeReleased(provider challenge.Provider, rs *recordSet) error {
+	if len(rs.Live) > 0 {
+		return nil
+	}
+	for value, r := range rs.Released {
+		if err := removeRecord(provider, *r); err != nil {
+			return err
+		}
+		delete(rs.Released, value)
+	}
+	return nil
+}
+
+// expire drops all references to values presented longer than maxAge
+// ago, e.g. by a client that died before cleaning up, and removes them
+// from the provider like a cleanup would. It returns the fqdns it
+// removed values for.
+func (s *recordStore) expire(provider challenge.Provider, maxAge time.Duration) ([]string, error) {
+	keys, err := s.store.List(recordPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for _, key := range keys {
+		fqdn := strings.TrimPrefix(key, recordPrefix)
+		removed, err := s.expireFQDN(provider, fqdn, maxAge)
+		if err != nil {
+			return expired, fmt.Errorf("%s: %v", fqdn, err)
+		}
+		if removed {
+			expired = append(expired, fqdn)
+		}
+	}
+	return expired, nil
+}
+
+func (s *recordStore) expireFQDN(provider challenge.Provider, fqdn string, maxAge time.Duration) (bool, error) {
+	// The zone is needed for the lock, load again once it is held
+	rs, err := s.load(fqdn)
+	if err != nil {
+		return false, err
+	}
+	var zone string
+	for _, r := range rs.Live {
+		zone = r.Zone
+	}
+	if len(zone) == 0 {
+		// Nothing live, or presented before records had a zone
+		return false, nil
+	}
+
+	unlock, err := s.store.Lock("zone/" + zone)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if rs, err = s.load(fqdn); err != nil {
+		return false, err
+	}
+	var removed bool
+	for value, r := range rs.Live {
+		if !r.Presented.IsZero() && time.Since(r.Presented) > maxAge {
+			delete(rs.Live, value)
+			r.Owners = make(map[string]int)
+			rs.Released[value] = r
+			removed = true
+		}
+	}
+
+	err = s.removeReleased(provider, rs)
+	if saveErr := s.save(fqdn, rs); err == nil {
+		err = saveErr
+	}
+	return removed && len(rs.Live) == 0, err
+}
+
+// createRecord creates the TXT record at the provider using the mode the
+// record was presented with
+func createRecord(provider challenge.Provider, rec record) error {
+	switch rec.Mode {
+	case ModeDefault:
+		p, ok := provider.(providerSolved)
+		if !ok {
+			return fmt.Errorf("provider does not support mode %s", rec.Mode)
+		}
+		if w, ok := provider.(providerWildcard); ok && rec.Wildcard {
+			return w.CreateWildcardRecord(rec.FQDN, rec.Value)
+		}
+		return p.CreateRecord(rec.FQDN, rec.Value)
+	case ModeRaw:
+		return provider.Present(rawDomain(provider, rec), rec.Token, rec.KeyAuth)
+	}
+	return fmt.Errorf("unknown mode %s", rec.Mode)
+}
+
+// removeRecord removes the TXT record from the provider using the mode
+// the record was presented with
+func removeRecord(provider challenge.Provider, rec record) error {
+	switch rec.Mode {
+	case ModeDefault:
+		p, ok := provider.(providerSolved)
+		if !ok {
+			return fmt.Errorf("provider does not support mode %s", rec.Mode)
+		}
+		return p.RemoveRecord(rec.FQDN, rec.Value)
+	case ModeRaw:
+		return provider.CleanUp(rawDomain(provider, rec), rec.Token, rec.KeyAuth)
+	}
+	return fmt.Errorf("unknown mode %s", rec.Mode)
+}
+
+// rawDomain returns the domain to pass to provider for a raw mode record.
+// The TXT record of a wildcard is that of its domain, only providers that
+// need to know about wildcards get *.<domain>.
+func rawDomain(provider challenge.Provider, rec record) string {
+	if _, ok := provider.(providerWildcard); ok && rec.Wildcard {
+		return "*." + rec.Domain
+	}
+	return rec.Domain
+}
@@ -0,0 +1,300 @@
+package acmeproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+// fakeProvider records the TXT values it was asked to create and remove
+type fakeProvider struct {
+	records map[string]map[string]bool
+	removes int
+	fail    bool
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{records: make(map[string]map[string]bool)}
+}
+
+func (p *fakeProvider) Present(domain, token, keyAuth string) error {
+	return p.CreateRecord("_acme-challenge."+domain+".", keyAuth)
+}
+
+func (p *fakeProvider) CleanUp(domain, token, keyAuth string) error {
+	return p.RemoveRecord("_acme-challenge."+domain+".", keyAuth)
+}
+
+func (p *fakeProvider) CreateRecord(fqdn, value string) error {
+	if p.fail {
+		return errors.New("provider failed")
+	}
+	if p.records[fqdn] == nil {
+		p.records[fqdn] = make(map[string]bool)
+	}
+	p.records[fqdn][value] = true
+	return nil
+}
+
+func (p *fakeProvider) RemoveRecord(fqdn, value string) error {
+	if p.fail {
+		return errors.New("provider failed")
+	}
+	p.removes++
+	delete(p.records[fqdn], value)
+	return nil
+}
+
+// values returns the number of values in DNS for testFQDN
+func (p *fakeProvider) values() int {
+	return len(p.records[testFQDN])
+}
+
+const testFQDN = "_acme-challenge.example.com."
+
+func testRecord(value string) record {
+	return record{FQDN: testFQDN, Value: value, Mode: ModeDefault}
+}
+
+func TestRecordsKeepSharedFQDN(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	// example.com and *.example.com share the fqdn with different values
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := records.present(provider, "example.com", "alice", testRecord("y")); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := records.cleanup(provider, "example.com", "alice", false, testRecord("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live != 1 || provider.values() != 2 || provider.removes != 0 {
+		t.Fatalf("after first cleanup: live %d, values %d, removes %d, want 1, 2, 0", live, provider.values(), provider.removes)
+	}
+
+	live, err = records.cleanup(provider, "example.com", "alice", false, testRecord("y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live != 0 || provider.values() != 0 {
+		t.Fatalf("after last cleanup: live %d, values %d, want 0, 0", live, provider.values())
+	}
+}
+
+func TestRecordsCountReferences(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	for _, owner := range []string{"alice", "bob", "bob"} {
+		if err := records.present(provider, "example.com", owner, testRecord("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, owner := range []string{"alice", "bob"} {
+		if _, err := records.cleanup(provider, "example.com", owner, false, testRecord("x")); err != nil {
+			t.Fatalf("cleanup %d: %v", i, err)
+		}
+		if provider.values() != 1 {
+			t.Fatalf("cleanup %d removed a value that is still referenced", i)
+		}
+	}
+
+	if _, err := records.cleanup(provider, "example.com", "bob", false, testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if provider.values() != 0 {
+		t.Fatal("value not removed after the last reference was dropped")
+	}
+}
+
+func TestRecordsCleanupNotOwner(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := records.cleanup(provider, "example.com", "bob", false, testRecord("x")); err != errNotOwner {
+		t.Fatalf("cleanup by another owner: got %v, want %v", err, errNotOwner)
+	}
+	if provider.values() != 1 {
+		t.Fatal("value removed by another owner")
+	}
+
+	if _, err := records.cleanup(provider, "example.com", "admin", true, testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if provider.values() != 0 {
+		t.Fatal("forced cleanup did not remove the value")
+	}
+}
+
+func TestRecordsPresentUnknownCleanedUpValue(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	// Cleaning up a value nobody presented, while x is still live, leaves
+	// it alone
+	if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord("y")); err != nil {
+		t.Fatal(err)
+	}
+	if provider.removes != 0 {
+		t.Fatalf("%d values removed while x is live", provider.removes)
+	}
+	if err := records.present(provider, "example.com", "alice", testRecord("y")); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.records[testFQDN]["y"] {
+		t.Fatal("y not created at the provider")
+	}
+
+	for _, value := range []string{"x", "y"} {
+		if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord(value)); err != nil {
+			t.Fatalf("cleanup %s: %v", value, err)
+		}
+	}
+	if provider.values() != 0 {
+		t.Fatalf("%d values left after cleaning up all of them", provider.values())
+	}
+}
+
+func TestRecordsReleasedKeptUntilLastCleanup(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	for _, value := range []string{"x", "y"} {
+		if err := records.present(provider, "example.com", "alice", testRecord(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	// x is released but still in DNS: presenting it again must not create
+	// it a second time, and it is live again
+	if err := records.present(provider, "example.com", "bob", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord("y")); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.records[testFQDN]["x"] {
+		t.Fatal("value presented again was removed")
+	}
+	if provider.removes != 0 {
+		t.Fatal("values removed while x is live again")
+	}
+
+	if _, err := records.cleanup(provider, "example.com", "bob", false, testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if provider.values() != 0 {
+		t.Fatalf("%d values left after cleaning up all of them", provider.values())
+	}
+}
+
+func TestRecordsProviderFailure(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	provider.fail = true
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err == nil {
+		t.Fatal("present succeeded with a failing provider")
+	}
+	provider.fail = false
+
+	// The failed present must not leave a reference behind
+	if _, err := records.cleanup(provider, "example.com", "bob", false, testRecord("x")); err != nil {
+		t.Fatalf("cleanup after failed present: %v", err)
+	}
+}
+
+func TestRecordsExpire(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	for _, value := range []string{"x", "y"} {
+		if err := records.present(provider, "example.com", "alice", testRecord(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired, err := records.expire(provider, time.Hour)
+	if err != nil || len(expired) != 0 || provider.values() != 2 {
+		t.Fatalf("expire of recent records: got %v, %v, %d values", expired, err, provider.values())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	expired, err = records.expire(provider, 5*time.Millisecond)
+	if err != nil || len(expired) != 1 || expired[0] != testFQDN {
+		t.Fatalf("expire of old records: got %v, %v", expired, err)
+	}
+	if provider.values() != 0 {
+		t.Fatalf("%d values left after expiry", provider.values())
+	}
+
+	// The owner cleaning up late is fine
+	if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord("x")); err != nil {
+		t.Fatalf("cleanup after expiry: %v", err)
+	}
+}
+
+// wildcardProvider is a provider that is told about wildcard records,
+// like an upstream acmeproxy
+type wildcardProvider struct {
+	*fakeProvider
+	wildcards int
+}
+
+func (p *wildcardProvider) CreateWildcardRecord(fqdn, value string) error {
+	p.wildcards++
+	return p.CreateRecord(fqdn, value)
+}
+
+func TestRecordsWildcard(t *testing.T) {
+	provider := &wildcardProvider{fakeProvider: newFakeProvider()}
+	records := newRecordStore(state.NewMemoryStore())
+
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	wildcard := testRecord("y")
+	wildcard.Wildcard = true
+	if err := records.present(provider, "example.com", "alice", wildcard); err != nil {
+		t.Fatal(err)
+	}
+	if provider.values() != 2 || provider.wildcards != 1 {
+		t.Fatalf("%d values in DNS, %d created as wildcard, want 2 and 1", provider.values(), provider.wildcards)
+	}
+}
+
+func TestRecordsCleanupUnknownValue(t *testing.T) {
+	provider := newFakeProvider()
+	records := newRecordStore(state.NewMemoryStore())
+
+	// A value left in DNS, e.g. from before a restart, is removed when no
+	// other value is live
+	provider.CreateRecord(testFQDN, "x")
+	if _, err := records.cleanup(provider, "example.com", "alice", false, testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if provider.values() != 0 {
+		t.Fatalf("%d values left after cleaning up an unknown value", provider.values())
+	}
+	if err := records.present(provider, "example.com", "alice", testRecord("x")); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.records[testFQDN]["x"] {
+		t.Fatal("x not created at the provider")
+	}
+}
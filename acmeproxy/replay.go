@@ -0,0 +1,38 @@
+package acmeproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/state"
+)
+
+// checkTimestamp checks that the unix time of a signed request is within
+// maxSkew of the server time
+func checkTimestamp(timestamp string, maxSkew time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("timestamp differs %s from server time", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// useNonce records the nonce of a signed request, which fails if it was
+// seen before. Nonces are kept for twice maxSkew: after that the timestamp
+// is rejected anyway.
+func useNonce(store state.Store, key, timestamp string, maxSkew time.Duration) error {
+	fresh, err := store.Add("nonces/"+key, []byte(timestamp), 2*maxSkew)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("nonce already used (replayed request)")
+	}
+	return nil
+}
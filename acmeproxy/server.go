@@ -2,7 +2,6 @@ package acmeproxy
 
 import (
 	"net/http"
-	"strconv"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/go-acme/lego/v3/challenge"
@@ -29,18 +28,34 @@ func NewServer(config *Config) (*Server, error) {
 	}, nil
 }
 
+// RunServer serves requests on all configured listeners until one of
+// them fails
 func RunServer(ctx *cli.Context, config *Config) {
-	if config.HttpServer.TLSConfig != nil {
-		log.WithFields(log.Fields{
-			"endpoint": "https://" + ctx.GlobalString("interface") + ":" + strconv.Itoa(ctx.GlobalInt("port")),
-			"addr":  config.HttpServer.Addr,
-		}).Info("Starting acmeproxy")
-		log.Fatal(config.HttpServer.ListenAndServeTLS("", ""))
-	} else {
-		log.WithFields(log.Fields{
-			"endpoint": "http://" + ctx.GlobalString("interface") + ":" + strconv.Itoa(ctx.GlobalInt("port")),
-			"addr":  config.HttpServer.Addr,
-		}).Info("Starting acmeproxy")
-		log.Fatal(config.HttpServer.ListenAndServe())
+	errs := make(chan error, len(config.Listeners))
+	for _, l := range config.Listeners {
+		go func(l *Listener) {
+			// Each listener gets its own server, as they can use
+			// different TLS settings
+			srv := &http.Server{
+				Handler:     config.HttpServer.Handler,
+				TLSConfig:   l.TLSConfig,
+				ConnContext: config.HttpServer.ConnContext,
+				ErrorLog:    config.HttpServer.ErrorLog,
+			}
+			if l.TLSConfig != nil {
+				log.WithFields(log.Fields{
+					"endpoint": "https://" + l.Name,
+					"addr":     l.Addr().String(),
+				}).Info("Starting acmeproxy")
+				errs <- srv.ServeTLS(l, "", "")
+			} else {
+				log.WithFields(log.Fields{
+					"endpoint": "http://" + l.Name,
+					"addr":     l.Addr().String(),
+				}).Info("Starting acmeproxy")
+				errs <- srv.Serve(l)
+			}
+		}(l)
 	}
+	log.Fatal(<-errs)
 }
@@ -1,20 +1,78 @@
 package acmeproxy
 
 import (
+	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
+
 	"github.com/go-acme/lego/v3/challenge"
+	"github.com/mdbraber/acmeproxy/state"
+	log "github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	HttpServer     *http.Server
-	Provider       challenge.Provider
-	ProviderName   string
-	HtpasswdFile   string
-	AllowedIPs     []string
+	HttpServer   *http.Server
+	Listeners    []*Listener
+	Provider     challenge.Provider
+	ProviderName string
+	HtpasswdFile string
+	AllowedIPs   []string
+	// TrustedProxies may set the client IP with X-Forwarded-For or X-Real-IP
+	TrustedProxies []*net.IPNet
 	AllowedDomains []string
 	AccesslogFile  string
+	AuditlogFile   string
+	AdminUsers     []string
+	AllowedUIDs    []string
+	State          state.Store
+	// RecordMaxAge removes TXT records that weren't cleaned up after it
+	// has passed, zero keeps them until they are cleaned up
+	RecordMaxAge time.Duration
+	// Lockout bans IPs and usernames after failed authentication
+	// attempts, nil disables it
+	Lockout *Lockout
+	// JWT validates bearer tokens, nil disables them
+	JWT *JWTAuthenticator
+	// HMAC checks signed requests, nil disables them
+	HMAC *HMACAuthenticator
+	// SSH checks requests signed with SSH host keys, nil disables them
+	SSH *SSHAuthenticator
+	// DNSBinding lets clients without credentials request domains that
+	// resolve to their IP, nil disables it
+	DNSBinding *DNSBinding
+	// Wildcards limits who may request wildcard certificates, nil allows
+	// anyone
+	Wildcards *WildcardPolicy
+	// Approvals makes requests for new domains wait for an admin, nil
+	// disables it
+	Approvals *Approvals
+	// Quotas limits names per owner and presents per base domain over
+	// long windows, nil disables them
+	Quotas *Quotas
+	// CertificateSources are reported by /health
+	CertificateSources []CertificateSource
+
+	records     *recordStore
+	auditLogger *log.Logger
+	// ipFilters holds a map of action to *IPFilter
+	ipFilters atomic.Value
 }
 
 func NewDefaultConfig() *Config {
-	return &Config{}
+	return &Config{
+		State: state.NewMemoryStore(),
+	}
+}
+
+// SetIPFilters replaces the IP filters for all actions at once, e.g. when
+// the configuration is reloaded
+func (c *Config) SetIPFilters(filters map[string]*IPFilter) {
+	c.ipFilters.Store(filters)
+}
+
+// IPFilters returns the IP filters per action
+func (c *Config) IPFilters() map[string]*IPFilter {
+	filters, _ := c.ipFilters.Load().(map[string]*IPFilter)
+	return filters
 }
@@ -0,0 +1,191 @@
+package acmeproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"github.com/mdbraber/acmeproxy/state"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// IdentityHost is the kind of identity of requests signed with an SSH
+// host key
+const IdentityHost string = "host"
+
+// SSHAuthenticator checks requests signed with an SSH host key (see
+// client.SSHSignRequest) against a known_hosts file. The hostnames listed
+// for the key limit the domains the caller may request. The file is read
+// again when it changes.
+type SSHAuthenticator struct {
+	file    string
+	maxSkew time.Duration
+	store   state.Store
+
+	mu       sync.Mutex
+	hosts    map[string][]string
+	revoked  map[string]bool
+	modified time.Time
+}
+
+// NewSSHAuthenticator loads the known_hosts file
+func NewSSHAuthenticator(file string, maxSkew time.Duration, store state.Store) (*SSHAuthenticator, error) {
+	a := &SSHAuthenticator{file: file, maxSkew: maxSkew, store: store}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the known_hosts file if it changed since it was last read
+func (a *SSHAuthenticator) load() error {
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	if a.hosts != nil && info.ModTime().Equal(a.modified) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	hosts := make(map[string][]string)
+	revoked := make(map[string]bool)
+	for len(data) > 0 {
+		var marker string
+		var patterns []string
+		var key ssh.PublicKey
+		marker, patterns, key, _, data, err = ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch marker {
+		case "revoked":
+			revoked[string(key.Marshal())] = true
+			continue
+		case "cert-authority":
+			log.WithFields(log.Fields{
+				"prefix": "ssh",
+				"file":   a.file,
+			}).Warning("Ignoring @cert-authority entry in known_hosts")
+			continue
+		}
+		for _, pattern := range patterns {
+			host, ok := knownHostname(pattern)
+			if !ok {
+				log.WithFields(log.Fields{
+					"prefix":  "ssh",
+					"file":    a.file,
+					"pattern": pattern,
+				}).Warning("Ignoring hashed or wildcard host in known_hosts")
+				continue
+			}
+			if net.ParseIP(host) != nil {
+				// IP addresses don't name a domain
+				continue
+			}
+			k := string(key.Marshal())
+			hosts[k] = append(hosts[k], host)
+		}
+	}
+
+	a.hosts, a.revoked, a.modified = hosts, revoked, info.ModTime()
+	log.WithFields(log.Fields{
+		"prefix": "ssh",
+		"file":   a.file,
+		"keys":   len(hosts),
+	}).Debug("Loaded known_hosts")
+	return nil
+}
+
+// knownHostname returns the hostname of a known_hosts pattern, which can't
+// be hashed, a wildcard or a negation
+func knownHostname(pattern string) (string, bool) {
+	if strings.HasPrefix(pattern, "|") || strings.ContainsAny(pattern, "*?!") {
+		return "", false
+	}
+	// [host]:port
+	if strings.HasPrefix(pattern, "[") {
+		end := strings.Index(pattern, "]")
+		if end < 0 {
+			return "", false
+		}
+		pattern = pattern[1:end]
+	}
+	return strings.ToLower(strings.TrimSuffix(pattern, ".")), true
+}
+
+// keyHosts returns the hostnames of key
+func (a *SSHAuthenticator) keyHosts(key ssh.PublicKey) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.load(); err != nil {
+		// Keep using the keys we have
+		log.WithFields(log.Fields{
+			"prefix": "ssh",
+			"file":   a.file,
+			"error":  err.Error(),
+		}).Error("Unable to load known_hosts")
+	}
+	k := string(key.Marshal())
+	if a.revoked[k] {
+		return nil, errors.New("revoked key")
+	}
+	hosts, ok := a.hosts[k]
+	if !ok {
+		return nil, errors.New("unknown key " + ssh.FingerprintSHA256(key))
+	}
+	return hosts, nil
+}
+
+// Authenticate checks the signature of r and returns the identity of the
+// host whose key signed it, limited to its hostnames. The body of r is
+// replaced, so it can be read again.
+func (a *SSHAuthenticator) Authenticate(r *http.Request, params *client.SignatureParams) (identity, error) {
+	if err := checkTimestamp(params.Timestamp, a.maxSkew); err != nil {
+		return identity{}, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(params.Signature)
+	if err != nil {
+		return identity{}, errors.New("invalid signature encoding")
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxSignedBody))
+	if err != nil {
+		return identity{}, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	message := client.SSHSigningString(r.Method, r.URL.EscapedPath(), params.Timestamp, params.Nonce, body)
+	key, err := client.SSHVerify(sig, client.SSHNamespace, []byte(message))
+	if err != nil {
+		return identity{}, err
+	}
+	hosts, err := a.keyHosts(key)
+	if err != nil {
+		return identity{}, err
+	}
+
+	// Only a valid signature uses up the nonce
+	if err := useNonce(a.store, "ssh/"+ssh.FingerprintSHA256(key)+"/"+params.Nonce, params.Timestamp, a.maxSkew); err != nil {
+		return identity{}, err
+	}
+	return identity{Kind: IdentityHost, Name: hosts[0], Domains: hosts}, nil
+}
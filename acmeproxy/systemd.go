@@ -0,0 +1,79 @@
+package acmeproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// systemdFile is a socket inherited from systemd
+type systemdFile struct {
+	name string
+	file *os.File
+}
+
+var (
+	systemdOnce  sync.Once
+	systemdFiles []systemdFile
+)
+
+// inheritSystemdFiles takes the sockets passed by systemd socket
+// activation (LISTEN_FDS) and clears the environment, so they aren't
+// passed on to child processes
+func inheritSystemdFiles() {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		systemdFiles = append(systemdFiles, systemdFile{name: name, file: os.NewFile(uintptr(fd), name)})
+	}
+}
+
+// systemdListeners returns the sockets inherited from systemd that
+// weren't taken yet. When name is set only sockets with that name
+// (FileDescriptorName= in the socket unit) are returned.
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemdOnce.Do(inheritSystemdFiles)
+
+	var listeners []net.Listener
+	for i, f := range systemdFiles {
+		if f.file == nil || (name != "" && f.name != name) {
+			continue
+		}
+		l, err := net.FileListener(f.file)
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s: %v", f.name, err)
+		}
+		// FileListener works on a duplicate, close the inherited one
+		f.file.Close()
+		systemdFiles[i].file = nil
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no sockets inherited from systemd (name: %q)", name)
+	}
+	return listeners, nil
+}
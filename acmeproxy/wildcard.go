@@ -0,0 +1,69 @@
+package acmeproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WildcardPolicy decides who may request challenges for wildcard
+// certificates of which domains. The first matching rule wins, the
+// default applies when none match.
+type WildcardPolicy struct {
+	rules        []*wildcardRule
+	defaultAllow bool
+}
+
+type wildcardRule struct {
+	allow  bool
+	domain string
+	owners []string
+	text   string
+}
+
+// NewWildcardPolicy parses rules like "allow example.com" or "deny
+// internal.example.com user:alice jwt:*": allow or deny, a domain (its
+// subdomains included, * for all) and optionally the owners (user:<name>,
+// hmac:<key ID>, jwt:<subject>, host:<hostname>, ip:<address>, <kind>:* or
+// *) the rule is limited to
+func NewWildcardPolicy(rules []string, defaultAllow bool) (*WildcardPolicy, error) {
+	p := &WildcardPolicy{defaultAllow: defaultAllow}
+	for _, text := range rules {
+		fields := strings.Fields(text)
+		if len(fields) < 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("invalid wildcard rule %q, expected allow|deny <domain> [owner...]", text)
+		}
+		p.rules = append(p.rules, &wildcardRule{
+			allow:  fields[0] == "allow",
+			domain: strings.ToLower(strings.TrimSuffix(fields[1], ".")),
+			owners: fields[2:],
+			text:   strings.Join(fields, " "),
+		})
+	}
+	return p, nil
+}
+
+// Allowed reports whether id may request a wildcard for domain (without
+// the "*."), and the rule that decided it
+func (p *WildcardPolicy) Allowed(domain string, id identity) (bool, string) {
+	for _, rule := range p.rules {
+		if rule.matches(domain, id) {
+			return rule.allow, rule.text
+		}
+	}
+	return p.defaultAllow, "default"
+}
+
+func (r *wildcardRule) matches(domain string, id identity) bool {
+	if r.domain != "*" && !domainMatches(domain, r.domain) {
+		return false
+	}
+	if len(r.owners) == 0 {
+		return true
+	}
+	for _, owner := range r.owners {
+		if owner == "*" || owner == id.Owner() || owner == id.Kind+":*" {
+			return true
+		}
+	}
+	return false
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/mdbraber/acmeproxy/cmd"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/urfave/cli.v1"
-	"gopkg.in/urfave/cli.v1/altsrc"
 )
 
 var (
@@ -42,6 +41,10 @@ AUTHOR{{with $length := len .Authors}}{{if ne 1 $length}}S{{end}}{{end}}:
    {{range $index, $author := .Authors}}{{if $index}}
    {{end}}{{$author}}{{end}}{{end}}{{if .VisibleCommands}}
 
+COMMANDS:{{range .VisibleCategories}}{{if .Name}}
+   {{.Name}}:{{end}}{{range .VisibleCommands}}
+     {{join .Names ", "}}{{"\t"}}{{.Usage}}{{end}}{{end}}
+
 OPTIONS:
    {{range $index, $option := .VisibleFlags}}{{if $index}}
    {{end}}{{$option}}{{end}}{{end}}{{if .Copyright}}
@@ -64,13 +67,35 @@ COPYRIGHT:
 	}
 
 	flags := cmd.CreateFlags(defaultPath)
-	app.Before = altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc("config-file"))
+	app.Before = cmd.InitInputSource(flags, "config-file")
 	app.Flags = flags
+	app.Commands = []cli.Command{
+		cmd.CreateClientCommand(),
+		cmd.CreateHookCommand(),
+		cmd.CreateBansCommand(),
+		cmd.CreateApprovalsCommand(),
+		cmd.CreateQuotasCommand(),
+	}
 
 	sort.Sort(cli.FlagsByName(app.Flags))
 
-	runErr := app.Run(os.Args)
+	// Allow using the binary as dehydrated HOOK without a wrapper script
+	args := os.Args
+	if len(args) > 1 && isDehydratedHook(args[1]) {
+		args = append([]string{args[0], "hook", "dehydrated"}, args[1:]...)
+	}
+
+	runErr := app.Run(args)
 	if runErr != nil {
 		log.Fatal(runErr)
 	}
 }
+
+func isDehydratedHook(arg string) bool {
+	for _, hook := range cmd.DehydratedHooks {
+		if arg == hook {
+			return true
+		}
+	}
+	return false
+}
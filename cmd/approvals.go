@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// CreateApprovalsCommand creates the approvals command, which works on
+// the state store of the server directly (using the server settings from
+// --config-file)
+func CreateApprovalsCommand() cli.Command {
+	domainFlag := cli.StringFlag{
+		Name:  "domain",
+		Usage: "`DOMAIN` to approve or remove",
+	}
+	return cli.Command{
+		Name:  "approvals",
+		Usage: "List, approve or remove domains when approval.required is set (needs a shared state store: file or redis)",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the requests waiting for approval and the approved domains",
+				Action: listApprovals,
+			},
+			{
+				Name:  "approve",
+				Usage: "Approve a domain",
+				Flags: []cli.Flag{
+					domainFlag,
+					cli.IntFlag{
+						Name:  "ttl",
+						Value: -1,
+						Usage: "`SECONDS` the approval lasts, 0 for no expiry (defaults to approval.ttl)",
+					},
+				},
+				Action: approveDomain,
+			},
+			{
+				Name:   "remove",
+				Usage:  "Reject the pending request for a domain or revoke its approval",
+				Flags:  []cli.Flag{domainFlag},
+				Action: removeApproval,
+			},
+		},
+	}
+}
+
+func listApprovals(ctx *cli.Context) error {
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	pending, approved, err := newApprovals(ctx, store).List()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to list approvals: %v", err), ExitServerError)
+	}
+	for _, p := range pending {
+		fmt.Printf("pending\t%s\t%s\t%s\t%s\n", p.Domain, p.Owner, p.IP, p.Requested.Local().Format(time.RFC3339))
+	}
+	for _, a := range approved {
+		expires := "no expiry"
+		if a.Expires != nil {
+			expires = "until " + a.Expires.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("approved\t%s\tby %s\t%s\n", a.Domain, a.ApprovedBy, expires)
+	}
+	return nil
+}
+
+func approveDomain(ctx *cli.Context) error {
+	domain := ctx.String("domain")
+	if len(domain) == 0 {
+		return cli.NewExitError("Please specify --domain", ExitUsage)
+	}
+
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	approvals := newApprovals(ctx, store)
+	ttl := approvals.TTL
+	if ctx.Int("ttl") >= 0 {
+		ttl = time.Duration(ctx.Int("ttl")) * time.Second
+	}
+	approval, err := approvals.Approve(domain, approvedBy(), ttl)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to approve %s: %v", domain, err), ExitServerError)
+	}
+	fmt.Printf("Approved %s\n", approval.Domain)
+	return nil
+}
+
+func removeApproval(ctx *cli.Context) error {
+	domain := ctx.String("domain")
+	if len(domain) == 0 {
+		return cli.NewExitError("Please specify --domain", ExitUsage)
+	}
+
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	if err := newApprovals(ctx, store).Remove(domain); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to remove %s: %v", domain, err), ExitServerError)
+	}
+	fmt.Printf("Removed %s\n", domain)
+	return nil
+}
+
+// approvedBy names the local user approving with the CLI
+func approvedBy() string {
+	if user := os.Getenv("USER"); len(user) > 0 {
+		return "cli:" + user
+	}
+	return "cli"
+}
@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+
+	xlog "github.com/go-acme/lego/v3/log"
+	"github.com/mdbraber/acmeproxy/acmeproxy"
+	"github.com/mholt/certmagic"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	AutoFallbackNone       string = "none"
+	AutoFallbackSelfSigned string = "self-signed"
+)
+
+// newAutoTLSConfig obtains and renews certificates for the ssl.auto.names
+// with certmagic. Clients are served the certificate matching their SNI,
+// or the one for ssl.auto.default-name when there is no match.
+func newAutoTLSConfig(ctx *cli.Context) (*tls.Config, *managedCertificates) {
+	log.Info("Setting up server using SSL (certmagic)")
+
+	salog := log.WithField("prefix", "ssl.auto")
+	xlog.Logger = salog
+
+	names := getAutoNames(ctx)
+	defaultName := ctx.GlobalString("ssl.auto.default-name")
+	if len(defaultName) == 0 {
+		defaultName = names[0]
+	}
+
+	cmProvider, err := newDNSProvider(ctx.GlobalString("ssl.auto.provider"))
+	if err != nil {
+		salog.WithField("error", err.Error()).Fatal("Unable to connect to a valid DNS provider for ssl.auto")
+	}
+
+	// FIXME check for errors with FileStorage?
+	certmagic.Default.Storage = &certmagic.FileStorage{Path: ctx.GlobalString("ssl.auto.path")}
+
+	var magic *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		// Renewals need the same configuration (CA, DNS provider) that
+		// obtained the certificate
+		GetConfigForCert: func(cert certmagic.Certificate) (certmagic.Config, error) {
+			return *magic, nil
+		},
+	})
+
+	// With ssl.auto.issuers certificates are stored under the first one
+	issuers := getIssuers(ctx)
+	ca := ctx.GlobalString("ssl.auto.ca")
+	if len(issuers) > 0 {
+		ca = issuers[0].URL
+	}
+
+	magic = certmagic.New(cache, certmagic.Config{
+		CA:                      ca,
+		Email:                   getEmail(ctx),
+		Agreed:                  ctx.GlobalBool("ssl.auto.agreed"),
+		KeyType:                 getKeyType(ctx),
+		DNSProvider:             cmProvider,
+		DisableHTTPChallenge:    true,
+		DisableTLSALPNChallenge: true,
+		DefaultServerName:       defaultName,
+		OnEvent:                 logCertmagicEvent,
+	})
+
+	if len(issuers) > 0 {
+		chain := newIssuerChain(magic, issuers, cmProvider)
+		magic.NewManager = func(interactive bool) (certmagic.Manager, error) {
+			return chain, nil
+		}
+	}
+
+	managed := &managedCertificates{magic: magic, names: names, failed: make(map[string]error)}
+
+	// Certificates in ssl.auto.path are loaded first, so a failure to
+	// obtain or renew doesn't stop acmeproxy; failed names are retried
+	// in the background
+	if failed := managed.manage(names); len(failed) > 0 {
+		switch fallback := ctx.GlobalString("ssl.auto.fallback"); fallback {
+		case AutoFallbackSelfSigned:
+			standIn, err := newSelfSignedCertificate(names)
+			if err != nil {
+				salog.WithField("error", err.Error()).Fatal("Unable to create a self-signed certificate")
+			}
+			managed.standIn = standIn
+			salog.WithField("names", failed).Warning("Serving a self-signed certificate until a certificate is obtained")
+		case AutoFallbackNone:
+			salog.WithField("names", failed).Warning("No certificate yet, HTTPS requests for these names fail until a certificate is obtained")
+		default:
+			salog.Fatalf("Unsupported ssl.auto.fallback: %s (supported: none or self-signed)", fallback)
+		}
+		go managed.retry(failed)
+	}
+
+	tlsConfig := magic.TLSConfig()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := magic.GetCertificate(hello)
+		if err != nil && hello.ServerName != "" {
+			// Unknown SNI: serve the default certificate instead of
+			// failing the handshake
+			fallback := *hello
+			fallback.ServerName = defaultName
+			cert, err = magic.GetCertificate(&fallback)
+		}
+		if err != nil && managed.standIn != nil {
+			return managed.standIn, nil
+		}
+		return cert, err
+	}
+
+	return tlsConfig, managed
+}
+
+// getAutoNames returns the names to obtain certificates for, the
+// interface if ssl.auto.names isn't set
+func getAutoNames(ctx *cli.Context) []string {
+	names := ctx.GlobalStringSlice("ssl.auto.names")
+	if len(names) == 0 && len(ctx.GlobalString("interface")) > 0 {
+		names = []string{ctx.GlobalString("interface")}
+	}
+	if len(names) == 0 {
+		log.Fatal("When using ssl.auto please specify the name(s) to get certificates for with --ssl.auto.names or --interface")
+	}
+	return names
+}
+
+// logCertmagicEvent logs certificate events through the lego logger
+func logCertmagicEvent(event string, data interface{}) {
+	switch event {
+	case "acme_cert_obtained":
+		xlog.Infof("[%v] Obtained certificate", data)
+	case "acme_cert_renewed":
+		xlog.Infof("[%v] Renewed certificate", data)
+	case "acme_cert_revoked":
+		xlog.Warnf("[%v] Revoked certificate", data)
+	case "cached_managed_cert":
+		xlog.Infof("%v Loaded certificate", data)
+	}
+}
+
+// managedCertificates keeps the certificates for the ssl.auto.names
+// managed by certmagic. While a name has no (valid) certificate it's
+// retried in the background, and acmeproxy reports itself as degraded.
+type managedCertificates struct {
+	magic   *certmagic.Config
+	names   []string
+	standIn *tls.Certificate
+
+	mu     sync.RWMutex
+	failed map[string]error
+}
+
+// manage loads or obtains the certificates for names and returns the
+// names that failed
+func (m *managedCertificates) manage(names []string) []string {
+	var failed []string
+	for _, name := range names {
+		err := m.magic.ManageSync([]string{name})
+
+		m.mu.Lock()
+		if err != nil {
+			m.failed[name] = err
+			failed = append(failed, name)
+		} else {
+			delete(m.failed, name)
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"prefix": "ssl.auto",
+				"name":   name,
+				"error":  err.Error(),
+			}).Error("Problem setting up certificate for ssl.auto")
+		}
+	}
+	return failed
+}
+
+// retry keeps trying the failed names with exponential backoff until all
+// of them have a certificate
+func (m *managedCertificates) retry(names []string) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 30 * time.Second
+	b.MaxInterval = time.Hour
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	for len(names) > 0 {
+		wait := b.NextBackOff()
+		log.WithFields(log.Fields{
+			"prefix": "ssl.auto",
+			"names":  names,
+		}).Infof("Retrying certificates in %s", wait.Round(time.Second))
+		time.Sleep(wait)
+		names = m.manage(names)
+	}
+
+	log.WithField("prefix", "ssl.auto").Info("All certificates for ssl.auto are available")
+}
+
+// Degraded returns the names without a certificate and why
+func (m *managedCertificates) Degraded() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var problems []string
+	for _, err := range m.failed {
+		// certmagic errors start with the name
+		problems = append(problems, "ssl.auto: "+err.Error())
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func (m *managedCertificates) Certificates() []acmeproxy.CertificateInfo {
+	var certs []acmeproxy.CertificateInfo
+	standIn := false
+	for _, name := range m.names {
+		cert, err := m.magic.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			standIn = m.standIn != nil
+			continue
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				continue
+			}
+		}
+		certs = append(certs, acmeproxy.NewCertificateInfo(acmeproxy.SourceAuto, leaf))
+	}
+	if standIn {
+		certs = append(certs, acmeproxy.NewCertificateInfo(acmeproxy.SourceSelfSigned, m.standIn.Leaf))
+	}
+	return certs
+}
+
+// newSelfSignedCertificate creates a stand-in certificate for names
+func newSelfSignedCertificate(names []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"acmeproxy self-signed"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
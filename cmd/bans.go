@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// CreateBansCommand creates the bans command, which works on the state
+// store of the server directly (using the server settings from
+// --config-file), so bans can be lifted even from a banned IP
+func CreateBansCommand() cli.Command {
+	return cli.Command{
+		Name:  "bans",
+		Usage: "List or clear bans after failed authentication attempts (needs a shared state store: file or redis)",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the current bans",
+				Action: listBans,
+			},
+			{
+				Name:  "clear",
+				Usage: "Lift the ban on an IP or username",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "ip",
+						Usage: "`IP` to lift the ban on",
+					},
+					cli.StringFlag{
+						Name:  "user",
+						Usage: "`USERNAME` to lift the ban on",
+					},
+				},
+				Action: clearBan,
+			},
+		},
+	}
+}
+
+func listBans(ctx *cli.Context) error {
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	bans, err := newLockout(ctx, store).Bans()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to list bans: %v", err), ExitServerError)
+	}
+	for _, ban := range bans {
+		fmt.Printf("%s\t%s\tuntil %s\t(%d failures)\n", ban.Kind, ban.Name, ban.Until.Local().Format(time.RFC3339), ban.Failures)
+	}
+	return nil
+}
+
+func clearBan(ctx *cli.Context) error {
+	kind, name := acmeproxy.BanIP, ctx.String("ip")
+	if len(name) == 0 {
+		kind, name = acmeproxy.BanUser, ctx.String("user")
+	}
+	if len(name) == 0 {
+		return cli.NewExitError("Please specify --ip or --user", ExitUsage)
+	}
+
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	if err := newLockout(ctx, store).Clear(kind, name); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to clear ban: %v", err), ExitServerError)
+	}
+	fmt.Printf("Cleared ban on %s %s\n", kind, name)
+	return nil
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+// Exit codes used by the client commands
+const (
+	ExitOK           int = 0
+	ExitUsage        int = 1
+	ExitConfig       int = 2
+	ExitUnreachable  int = 3
+	ExitUnauthorized int = 4
+	ExitRejected     int = 5
+	ExitServerError  int = 6
+)
+
+// CreateClientCommand creates the client command and its subcommands
+func CreateClientCommand() cli.Command {
+	return cli.Command{
+		Name:  "client",
+		Usage: "Present or clean up a DNS challenge at an acmeproxy server",
+		Subcommands: []cli.Command{
+			newClientActionCommand(client.ActionPresent, "Present a TXT record"),
+			newClientActionCommand(client.ActionCleanup, "Clean up a TXT record"),
+		},
+	}
+}
+
+func newClientActionCommand(action string, usage string) cli.Command {
+	flags := append(createClientFlags(),
+		cli.StringFlag{
+			Name:  "fqdn",
+			Usage: "FQDN of the TXT record, e.g. _acme-challenge.example.com. (default mode)",
+		},
+		cli.StringFlag{
+			Name:  "value",
+			Usage: "Value of the TXT record (default mode)",
+		},
+		cli.BoolFlag{
+			Name:  "wildcard",
+			Usage: "The TXT record is for a wildcard certificate (default mode, in raw mode use --domain *.example.com)",
+		},
+		cli.StringFlag{
+			Name:  "domain",
+			Usage: "Domain to request the challenge for (raw mode)",
+		},
+		cli.StringFlag{
+			Name:  "token",
+			Usage: "ACME challenge token (raw mode)",
+		},
+		cli.StringFlag{
+			Name:  "keyauth",
+			Usage: "ACME key authorization (raw mode)",
+		},
+	)
+
+	return cli.Command{
+		Name:   action,
+		Usage:  usage,
+		Flags:  flags,
+		Before: InitInputSource(flags, "client-config"),
+		Action: func(ctx *cli.Context) error {
+			var msg interface{}
+			switch {
+			case ctx.String("fqdn") != "" && ctx.String("value") != "":
+				msg = &client.Message{FQDN: dns01.ToFqdn(ctx.String("fqdn")), Value: ctx.String("value"), Wildcard: ctx.Bool("wildcard")}
+			case ctx.String("domain") != "" && (ctx.String("token") != "" || ctx.String("keyauth") != ""):
+				msg = &client.RawMessage{Domain: ctx.String("domain"), Token: ctx.String("token"), KeyAuth: ctx.String("keyauth")}
+			default:
+				return cli.NewExitError("Please specify --fqdn and --value, or --domain with --token/--keyauth", ExitUsage)
+			}
+
+			c, err := newClient(ctx)
+			if err != nil {
+				return err
+			}
+
+			return clientExitError(c.Do(action, msg))
+		},
+	}
+}
+
+// createClientFlags creates the flags shared by all commands talking to an
+// acmeproxy server
+func createClientFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "client-config",
+			Value: "/etc/acmeproxy/client.yml",
+			Usage: "Load client configuration from `FILE`",
+		},
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:   "server",
+			EnvVar: "ACMEPROXY_ENDPOINT",
+			Usage:  "`URL` of the acmeproxy server, e.g. https://acmeproxy.example.com:9095 (repeat to fail over between servers)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "username",
+			EnvVar: "ACMEPROXY_USERNAME",
+			Usage:  "Username for basic authentication",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "password",
+			EnvVar: "ACMEPROXY_PASSWORD",
+			Usage:  "Password for basic authentication",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "bearer-token",
+			EnvVar: "ACMEPROXY_TOKEN",
+			Usage:  "Bearer `TOKEN` for authentication (instead of username/password)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "hmac-key-id",
+			EnvVar: "ACMEPROXY_HMAC_KEY_ID",
+			Usage:  "`ID` of the shared key to sign requests with (instead of username/password)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "hmac-key",
+			EnvVar: "ACMEPROXY_HMAC_KEY",
+			Usage:  "Shared `KEY` (base64) to sign requests with",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "ssh-key-file",
+			EnvVar: "ACMEPROXY_SSH_KEY_FILE",
+			Usage:  "SSH private key `FILE` (e.g. /etc/ssh/ssh_host_ed25519_key) to sign requests with",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "ca-file",
+			EnvVar: "ACMEPROXY_CA_FILE",
+			Usage:  "CA bundle `FILE` to verify the server certificate with",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "cert-file",
+			EnvVar: "ACMEPROXY_CERT_FILE",
+			Usage:  "Client certificate `FILE`",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:   "key-file",
+			EnvVar: "ACMEPROXY_KEY_FILE",
+			Usage:  "Client certificate key `FILE`",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:   "timeout",
+			Value:  30,
+			EnvVar: "ACMEPROXY_HTTP_TIMEOUT",
+			Usage:  "`SECONDS` to wait for the server to respond",
+		}),
+	}
+}
+
+// newClient sets up a client from the client flags
+func newClient(ctx *cli.Context) (*client.Client, error) {
+	if len(ctx.StringSlice("server")) == 0 {
+		return nil, cli.NewExitError("Please specify the acmeproxy server with --server", ExitUsage)
+	}
+
+	config := client.NewDefaultConfig()
+	config.Endpoints = ctx.StringSlice("server")
+	config.Username = ctx.String("username")
+	config.Password = ctx.String("password")
+	config.Token = ctx.String("bearer-token")
+	config.HMACKeyID = ctx.String("hmac-key-id")
+	config.HMACKey = ctx.String("hmac-key")
+	config.SSHKeyFile = ctx.String("ssh-key-file")
+	config.CAFile = ctx.String("ca-file")
+	config.CertFile = ctx.String("cert-file")
+	config.KeyFile = ctx.String("key-file")
+	config.HTTPTimeout = time.Duration(ctx.Int("timeout")) * time.Second
+
+	c, err := client.New(config)
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), ExitConfig)
+	}
+	return c, nil
+}
+
+// clientExitError maps an error returned by the client to an exit code
+func clientExitError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var clientErr *client.Error
+	if errors.As(err, &clientErr) {
+		code := ExitRejected
+		switch {
+		case clientErr.StatusCode == 401 || clientErr.StatusCode == 403:
+			code = ExitUnauthorized
+		case clientErr.StatusCode >= 500:
+			code = ExitServerError
+		}
+		if len(clientErr.RequestID) > 0 {
+			return cli.NewExitError(fmt.Sprintf("Request rejected by acmeproxy (%v, %s, request ID %s)", err, clientErr.Code, clientErr.RequestID), code)
+		}
+		return cli.NewExitError(fmt.Sprintf("Request rejected by acmeproxy (%v)", err), code)
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return cli.NewExitError(fmt.Sprintf("Unable to reach acmeproxy: %v", err), ExitUnreachable)
+	}
+
+	return cli.NewExitError(err.Error(), ExitServerError)
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/mholt/certmagic"
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/urfave/cli.v1/altsrc"
@@ -24,6 +26,14 @@ func CreateFlags(defaultPath string) []cli.Flag {
 			Value: 9095,
 			Usage: "Port to bind for requests",
 		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "listen",
+			Usage: "Listen on these addresses instead of interface:port: host:port, unix:/path (options: mode=0660 owner=user group=group) or systemd[:name] for sockets passed by systemd. All take ssl=none|manual|auto to override --ssl",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "proxy-protocol",
+			Usage: "Accept PROXY protocol (v1/v2) headers on TCP listeners from these upstream IP(s) (CIDR notation possible), e.g. HAProxy in TCP mode. Disable per listener with proxy-protocol=off",
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "provider",
 			Value: "",
@@ -39,13 +49,191 @@ func CreateFlags(defaultPath string) []cli.Flag {
 		}),
 		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
 			Name:  "allowed-ips",
-			Usage: "Set the allowed IP(s) that can request certificates (CIDR notation possible, see https://github.com/jpillora/ipfilter)",
+			Usage: "Set the allowed IP(s) or hostname(s) that can request certificates (IPv4/IPv6, CIDR notation possible)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "allowed-ips.present",
+			Usage: "Set the allowed IP(s) or hostname(s) for /present (instead of --allowed-ips)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "allowed-ips.cleanup",
+			Usage: "Set the allowed IP(s) or hostname(s) for /cleanup (instead of --allowed-ips)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "denied-ips",
+			Usage: "Set the denied IP(s) or hostname(s), these take precedence over --allowed-ips (IPv4/IPv6, CIDR notation possible)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "denied-ips.present",
+			Usage: "Set the denied IP(s) or hostname(s) for /present (instead of --denied-ips)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "denied-ips.cleanup",
+			Usage: "Set the denied IP(s) or hostname(s) for /cleanup (instead of --denied-ips)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "ip-filter.refresh-interval",
+			Value: 300,
+			Usage: "Resolve hostnames in the allowed and denied IPs again every `SECONDS` (0 to disable)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "trusted-proxies",
+			Usage: "Set the reverse prox(y/ies) (CIDR notation possible) allowed to pass the client IP with X-Forwarded-For or X-Real-IP",
 		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "accesslog-file",
 			Value: "",
 			Usage: "Location of additional accesslog `FILE`",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "auditlog-file",
+			Value: "",
+			Usage: "Location of audit log `FILE` for security relevant events (JSON)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "admin-users",
+			Usage: "Set the user(s) with an admin role, e.g. allowed to clean up records of other clients",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "hmac-keys-file",
+			Usage: "Accept requests signed with the shared keys in `FILE` (<key ID>:<base64 key> per line)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "hmac.max-skew",
+			Value: 300,
+			Usage: "Maximum `SECONDS` the timestamp of a request signed with a shared key may differ from the server time",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "ssh-known-hosts-file",
+			Usage: "Accept requests signed with the SSH host keys in known_hosts `FILE`, limited to the hostnames of the key",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "ssh.max-skew",
+			Value: 300,
+			Usage: "Maximum `SECONDS` the timestamp of a request signed with an SSH host key may differ from the server time",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "wildcard.rules",
+			Usage: "Allow or deny wildcard certificates, first match wins: allow|deny <domain> (subdomains included, * for all) [owner...] (user:<name>, hmac:<key ID>, jwt:<subject>, host:<hostname>, ip:<address>, <kind>:* or *)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "wildcard.default",
+			Value: "allow",
+			Usage: "Allow or deny wildcard certificates not matched by --wildcard.rules (allow|deny)",
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:  "dns-binding",
+			Usage: "Let clients without credentials request domains with an A/AAAA record of their IP, or the PTR record of their IP",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "dns-binding.resolvers",
+			Usage: "DNS servers (host or host:port) to resolve domains and client IPs with for --dns-binding, tried in order (defaults to the servers in /etc/resolv.conf)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "dns-binding.timeout",
+			Value: 5,
+			Usage: "`SECONDS` to wait for the DNS servers of --dns-binding",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "jwt.issuers",
+			Usage: "Accept bearer tokens (JWT) from these issuers: issuer URL with audience= (required, accepted aud claims) and optional jwks= (JWKS file or URL, defaults to OpenID Connect discovery) and domains-claim= (claim with the allowed domains, default: domains)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "jwt.refresh-interval",
+			Value: 3600,
+			Usage: "Fetch the JWKS of the issuers again every `SECONDS`",
+		}),
+		altsrc.NewBoolFlag(cli.BoolFlag{
+			Name:  "approval.required",
+			Usage: "Make requests for domains that weren't approved before wait for an admin (acmeproxy approvals or /admin/approvals)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "approval.ttl",
+			Value: 0,
+			Usage: "`SECONDS` an approval lasts (0 for no expiry)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "approval.pending-ttl",
+			Value: 604800,
+			Usage: "`SECONDS` to keep a request waiting for approval",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "approval.notify-url",
+			Usage: "Webhook `URL` to POST new requests waiting for approval to (JSON, with a text field for Slack or Mattermost)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "quota.names",
+			Usage: "Allow each owner (user, shared key, token subject, host or IP) at most `NUMBER` distinct names per --quota.names-window (0 for no limit)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "quota.names-window",
+			Value: 604800,
+			Usage: "`SECONDS` to count distinct names per owner in",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "quota.presents",
+			Usage: "Allow at most `NUMBER` presents per base domain (e.g. example.co.uk) per --quota.presents-window (0 for no limit)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "quota.presents-window",
+			Value: 86400,
+			Usage: "`SECONDS` to count presents per base domain in",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "lockout.threshold",
+			Usage: "Ban an IP or username after `NUMBER` failed authentication attempts within --lockout.window (0 to disable)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "lockout.window",
+			Value: 600,
+			Usage: "`SECONDS` to count failed authentication attempts in",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "lockout.ban-time",
+			Value: 900,
+			Usage: "`SECONDS` to ban an IP or username for, doubling for every repeated ban",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "lockout.max-ban-time",
+			Value: 86400,
+			Usage: "Maximum `SECONDS` to ban an IP or username for",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "allowed-uids",
+			Usage: "Set the local user(s) (name or uid) that don't need to authenticate when connecting over a unix socket",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state",
+			Value: "memory",
+			Usage: "Store for outstanding records and counters, shared when running multiple instances (memory|file|redis)",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "records.max-age",
+			Usage: "Remove TXT records that weren't cleaned up after `SECONDS` (0 keeps them until cleaned up)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state.path",
+			Value: defaultPath + "/state",
+			Usage: "`PATH` to store state in (when using --state file)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state.redis.address",
+			Value: "127.0.0.1:6379",
+			Usage: "Redis server `ADDRESS` (host:port or socket path, when using --state redis)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state.redis.password",
+			Usage: "Redis password",
+		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "state.redis.db",
+			Usage: "Redis database number",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state.redis.prefix",
+			Value: "acmeproxy:",
+			Usage: "Prefix for all Redis keys",
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "log-level",
 			Value: "info",
@@ -65,7 +253,7 @@ func CreateFlags(defaultPath string) []cli.Flag {
 		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "ssl",
-			Usage: "Provide a HTTPS connection when listening to interface:port (supported: auto or manual)",
+			Usage: "Provide a HTTPS connection when listening to interface:port or listen addresses without ssl= (supported: auto or manual)",
 		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "ssl.manual.cert-file",
@@ -77,6 +265,24 @@ func CreateFlags(defaultPath string) []cli.Flag {
 			Value: "",
 			Usage: "Location of key `FILE` (when using --ssl/-s)",
 		}),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:  "ssl.manual.reload-interval",
+			Value: 60,
+			Usage: "Check the certificate and key files for changes every `SECONDS` (0 to disable)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "ssl.min-version",
+			Value: "1.2",
+			Usage: "Minimum TLS `VERSION` (1.0, 1.1, 1.2 or 1.3)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "ssl.cipher-suites",
+			Usage: "Allowed cipher suites for TLS 1.2 and lower, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (defaults to Go's selection)",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "ssl.curves",
+			Usage: "Elliptic curves in order of preference (X25519, P256, P384 or P521)",
+		}),
 		altsrc.NewBoolFlag(cli.BoolFlag{
 			Name:  "ssl.auto.agreed",
 			Usage: "Read and agree to your CA's legal documents",
@@ -92,11 +298,28 @@ func CreateFlags(defaultPath string) []cli.Flag {
 			Value: certmagic.LetsEncryptProductionCA,
 			Usage: "Certmagic CA endpoint",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "ssl.auto.fallback",
+			Value: "none",
+			Usage: "What to serve for names without a certificate (cached or obtained) while it's retried in the background: none (HTTPS fails for those names) or self-signed",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "ssl.auto.issuers",
+			Usage: "ACME CAs to try in order instead of --ssl.auto.ca: directory URL with optional eab-kid=, eab-hmac= (External Account Binding) and root= (CA certificate file for private CAs)",
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "ssl.auto.key-type",
 			Value: "rsa2048",
 			Usage: "Key type to use for private keys. Supported: rsa2048, rsa4096, rsa8192, ec256, ec384.",
 		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "ssl.auto.names",
+			Usage: "Names to get certificates for, served by SNI (defaults to --interface)",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "ssl.auto.default-name",
+			Usage: "Name of the certificate to serve when a client asks for an unknown name or no name (defaults to the first of --ssl.auto.names)",
+		}),
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name:  "ssl.auto.path",
 			Value: defaultPath + "/certmagic",
@@ -114,3 +337,14 @@ func CreateFlags(defaultPath string) []cli.Flag {
 		}),
 	}
 }
+
+// InitInputSource loads flag values from the YAML file named by the flag
+// flagFileName. A missing file is only an error when the flag was set.
+func InitInputSource(flags []cli.Flag, flagFileName string) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		if _, err := os.Stat(ctx.String(flagFileName)); os.IsNotExist(err) && !ctx.IsSet(flagFileName) {
+			return nil
+		}
+		return altsrc.InitInputSourceWithContext(flags, altsrc.NewYamlSourceFromFlagFunc(flagFileName))(ctx)
+	}
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+// DehydratedHooks are the hook names dehydrated calls its hook with. When
+// the binary is used as dehydrated HOOK directly, the first argument is
+// one of these.
+var DehydratedHooks = []string{
+	"deploy_challenge", "clean_challenge", "sync_cert", "deploy_cert", "deploy_ocsp",
+	"unchanged_cert", "invalid_challenge", "request_failure", "generate_csr",
+	"startup_hook", "exit_hook",
+	"this_hookscript_is_broken__dehydrated_is_working_fine__please_ignore_unknown_hooks_in_your_script",
+}
+
+// CreateHookCommand creates the hook command for certbot and dehydrated
+func CreateHookCommand() cli.Command {
+	return cli.Command{
+		Name:  "hook",
+		Usage: "Run as certbot or dehydrated hook",
+		Subcommands: []cli.Command{
+			newHookCommand("certbot-auth", "Present the challenge from CERTBOT_DOMAIN/CERTBOT_VALIDATION (certbot --manual-auth-hook)", "", certbotHook(client.ActionPresent)),
+			newHookCommand("certbot-cleanup", "Clean up the challenge from CERTBOT_DOMAIN/CERTBOT_VALIDATION (certbot --manual-cleanup-hook)", "", certbotHook(client.ActionCleanup)),
+			newHookCommand("dehydrated", "Handle deploy_challenge/clean_challenge (dehydrated HOOK)", "HOOK [DOMAIN TOKEN_FILENAME TOKEN_VALUE]...", dehydratedHook),
+		},
+	}
+}
+
+func newHookCommand(name string, usage string, argsUsage string, action func(ctx *cli.Context) error) cli.Command {
+	flags := append(createClientFlags(),
+		altsrc.NewIntFlag(cli.IntFlag{
+			Name:   "wait",
+			EnvVar: "ACMEPROXY_HOOK_WAIT",
+			Usage:  "`SECONDS` to wait after presenting a challenge, to allow the TXT record to propagate",
+		}),
+	)
+
+	return cli.Command{
+		Name:      name,
+		Usage:     usage,
+		ArgsUsage: argsUsage,
+		Flags:     flags,
+		Before:    InitInputSource(flags, "client-config"),
+		Action:    action,
+	}
+}
+
+// certbotHook handles the certbot manual auth and cleanup hooks
+func certbotHook(action string) func(ctx *cli.Context) error {
+	return func(ctx *cli.Context) error {
+		domain := os.Getenv("CERTBOT_DOMAIN")
+		validation := os.Getenv("CERTBOT_VALIDATION")
+		if domain == "" || validation == "" {
+			return cli.NewExitError("CERTBOT_DOMAIN and CERTBOT_VALIDATION must be set (run as certbot --manual-auth-hook/--manual-cleanup-hook)", ExitUsage)
+		}
+
+		c, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = clientExitError(c.Do(action, challengeMessage(domain, validation)))
+		if err == nil && action == client.ActionPresent {
+			waitForPropagation(ctx)
+		}
+		return err
+	}
+}
+
+// dehydratedHook handles the dehydrated hook conventions. With HOOK_CHAIN
+// enabled dehydrated passes several DOMAIN TOKEN_FILENAME TOKEN_VALUE
+// triples in a single call. Hooks it doesn't handle are ignored before
+// the client configuration is checked, so they can't fail.
+func dehydratedHook(ctx *cli.Context) error {
+	hook := ctx.Args().First()
+	args := ctx.Args().Tail()
+
+	var action string
+	switch hook {
+	case "deploy_challenge":
+		action = client.ActionPresent
+	case "clean_challenge":
+		action = client.ActionCleanup
+	default:
+		// dehydrated expects unknown hooks to be ignored
+		return nil
+	}
+
+	if len(args) == 0 || len(args)%3 != 0 {
+		return cli.NewExitError(fmt.Sprintf("%s expects DOMAIN TOKEN_FILENAME TOKEN_VALUE arguments", hook), ExitUsage)
+	}
+
+	c, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var failed []error
+	for i := 0; i < len(args); i += 3 {
+		domain, value := args[i], args[i+2]
+		err := clientExitError(c.Do(action, challengeMessage(domain, value)))
+		if err != nil {
+			// Deploying fails fast, but clean up as much as possible
+			if action == client.ActionPresent {
+				return err
+			}
+			log.WithField("domain", domain).Error(err.Error())
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed[0]
+	}
+	if action == client.ActionPresent {
+		waitForPropagation(ctx)
+	}
+	return nil
+}
+
+// challengeMessage builds the default mode payload for the TXT value of domain
+func challengeMessage(domain, value string) *client.Message {
+	fqdn := dns01.ToFqdn("_acme-challenge." + strings.TrimPrefix(domain, "*."))
+	return &client.Message{FQDN: fqdn, Value: value, Wildcard: strings.HasPrefix(domain, "*.")}
+}
+
+func waitForPropagation(ctx *cli.Context) {
+	if ctx.Int("wait") > 0 {
+		time.Sleep(time.Duration(ctx.Int("wait")) * time.Second)
+	}
+}
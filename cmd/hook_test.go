@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestChallengeMessage(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   client.Message
+	}{
+		{domain: "example.com", want: client.Message{FQDN: "_acme-challenge.example.com.", Value: "v"}},
+		{domain: "*.example.com", want: client.Message{FQDN: "_acme-challenge.example.com.", Value: "v", Wildcard: true}},
+	}
+
+	for _, test := range tests {
+		if got := challengeMessage(test.domain, "v"); *got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.domain, *got, test.want)
+		}
+	}
+}
+
+// runHook runs acmeproxy hook with args, with a client configuration
+// file without a server
+func runHook(t *testing.T, hook string, args ...string) error {
+	os.Unsetenv("ACMEPROXY_SERVER")
+	f, err := ioutil.TempFile("", "acmeproxy-client-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("wait: 0\n")
+	f.Close()
+
+	exiter := cli.OsExiter
+	cli.OsExiter = func(int) {}
+	defer func() { cli.OsExiter = exiter }()
+
+	app := cli.NewApp()
+	app.Writer, app.ErrWriter = ioutil.Discard, ioutil.Discard
+	app.Commands = []cli.Command{CreateHookCommand()}
+	return app.Run(append([]string{"acmeproxy", "hook", hook, "--client-config", f.Name()}, args...))
+}
+
+// TestDehydratedIgnoredHooks checks hooks acmeproxy doesn't handle
+// succeed without a client configuration
+func TestDehydratedIgnoredHooks(t *testing.T) {
+	for _, hook := range DehydratedHooks {
+		if hook == "deploy_challenge" || hook == "clean_challenge" {
+			continue
+		}
+		if err := runHook(t, "dehydrated", hook, "example.com"); err != nil {
+			t.Errorf("%s: %v", hook, err)
+		}
+	}
+
+	if err := runHook(t, "dehydrated", "deploy_challenge", "example.com", "token", "value"); err == nil {
+		t.Error("deploy_challenge succeeded without a server")
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/urfave/cli.v1/altsrc"
+)
+
+// newIPFilters compiles the IP filter for every action. An action uses
+// allowed-ips.<action> and denied-ips.<action> when they are set, the
+// global allowed-ips and denied-ips otherwise. get returns the value of
+// a setting.
+func newIPFilters(get func(name string) ([]string, error)) (map[string]*acmeproxy.IPFilter, error) {
+	filters := make(map[string]*acmeproxy.IPFilter)
+	for _, action := range []string{acmeproxy.ActionPresent, acmeproxy.ActionCleanup} {
+		allow, err := getList(get, "allowed-ips."+action, "allowed-ips")
+		if err != nil {
+			return nil, err
+		}
+		deny, err := getList(get, "denied-ips."+action, "denied-ips")
+		if err != nil {
+			return nil, err
+		}
+
+		filter, err := acmeproxy.NewIPFilter(allow, deny)
+		if err != nil {
+			return nil, err
+		}
+		filters[action] = filter
+	}
+	return filters, nil
+}
+
+// getList returns the first of the settings names that is set
+func getList(get func(name string) ([]string, error), names ...string) ([]string, error) {
+	for _, name := range names {
+		list, err := get(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(list) > 0 {
+			return list, nil
+		}
+	}
+	return nil, nil
+}
+
+// watchIPFilters resolves the hostnames in the IP filters again every
+// ip-filter.refresh-interval seconds, and rebuilds the filters from the
+// config file on SIGHUP
+func watchIPFilters(ctx *cli.Context, config *acmeproxy.Config) {
+	var tick <-chan time.Time
+	if interval := ctx.GlobalInt("ip-filter.refresh-interval"); interval > 0 {
+		tick = time.NewTicker(time.Duration(interval) * time.Second).C
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-tick:
+			for _, filter := range config.IPFilters() {
+				filter.Resolve()
+			}
+		case <-hup:
+			reloadIPFilters(ctx, config)
+		}
+	}
+}
+
+// reloadIPFilters swaps in the IP filters from the config file. Settings
+// given on the command line override the file, like they do at startup.
+// The current filters are kept when the file can't be read or is invalid.
+func reloadIPFilters(ctx *cli.Context, config *acmeproxy.Config) {
+	rlog := log.WithField("prefix", "ipfilter")
+
+	file := ctx.GlobalString("config-file")
+	if len(file) == 0 {
+		rlog.Warning("No config-file to reload IP filters from")
+		return
+	}
+	source, err := altsrc.NewYamlSourceFromFile(file)
+	if err != nil {
+		rlog.WithField("error", err.Error()).Error("Unable to reload IP filters")
+		return
+	}
+
+	filters, err := newIPFilters(func(name string) ([]string, error) {
+		if ctx.GlobalIsSet(name) {
+			return ctx.GlobalStringSlice(name), nil
+		}
+		return source.StringSlice(name)
+	})
+	if err != nil {
+		rlog.WithField("error", err.Error()).Error("Invalid IP filter in config-file, keeping the current filters")
+		return
+	}
+
+	config.SetIPFilters(filters)
+	rlog.WithField("file", file).Info("Reloaded IP filters")
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// TestReloadIPFilters checks that a reload takes the IP filters from the
+// config file, and keeps those given on the command line
+func TestReloadIPFilters(t *testing.T) {
+	f, err := ioutil.TempFile("", "acmeproxy-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	write := func(config string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("allowed-ips.cleanup:\n - \"192.0.2.1\"\n")
+
+	type check struct {
+		action  string
+		ip      string
+		allowed bool
+	}
+	tests := []struct {
+		name   string
+		config string
+		checks []check
+	}{
+		{
+			name:   "initial",
+			checks: []check{{acmeproxy.ActionPresent, "198.51.100.1", true}, {acmeproxy.ActionPresent, "203.0.113.1", false}, {acmeproxy.ActionCleanup, "192.0.2.1", true}, {acmeproxy.ActionCleanup, "198.51.100.1", false}},
+		},
+		{
+			// allowed-ips from the command line stays, the file changes
+			// the cleanup list
+			name:   "reloaded",
+			config: "allowed-ips:\n - \"203.0.113.1\"\nallowed-ips.cleanup:\n - \"192.0.2.2\"\n",
+			checks: []check{{acmeproxy.ActionPresent, "198.51.100.1", true}, {acmeproxy.ActionPresent, "203.0.113.1", false}, {acmeproxy.ActionCleanup, "192.0.2.2", true}, {acmeproxy.ActionCleanup, "192.0.2.1", false}},
+		},
+		{
+			// A file without IP filters leaves the command line ones
+			name:   "empty file",
+			config: "log-level: info\n",
+			checks: []check{{acmeproxy.ActionPresent, "203.0.113.1", false}, {acmeproxy.ActionCleanup, "203.0.113.1", false}, {acmeproxy.ActionCleanup, "198.51.100.1", true}},
+		},
+	}
+
+	flags := CreateFlags(os.TempDir())
+	app := cli.NewApp()
+	app.Flags = flags
+	app.Before = InitInputSource(flags, "config-file")
+	app.Writer, app.ErrWriter = ioutil.Discard, ioutil.Discard
+	app.Action = func(ctx *cli.Context) error {
+		config := acmeproxy.NewDefaultConfig()
+		filters, err := newIPFilters(func(name string) ([]string, error) {
+			return ctx.GlobalStringSlice(name), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.SetIPFilters(filters)
+
+		for _, test := range tests {
+			if len(test.config) > 0 {
+				write(test.config)
+				reloadIPFilters(ctx, config)
+			}
+			for _, c := range test.checks {
+				if allowed, rule := config.IPFilters()[c.action].Allowed(c.ip); allowed != c.allowed {
+					t.Errorf("%s: %s from %s: got allowed %v (%s), want %v", test.name, c.action, c.ip, allowed, rule, c.allowed)
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := app.Run([]string{"acmeproxy", "--config-file", f.Name(), "--allowed-ips", "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/certificate"
+	"github.com/go-acme/lego/v3/challenge"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/go-acme/lego/v3/lego"
+	xlog "github.com/go-acme/lego/v3/log"
+	"github.com/go-acme/lego/v3/registration"
+	"github.com/mholt/certmagic"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// acmeIssuer is a CA from ssl.auto.issuers, e.g.
+// "https://ca.internal/acme/acme/directory eab-kid=KID eab-hmac=HMAC root=/etc/acmeproxy/root.pem"
+type acmeIssuer struct {
+	URL     string
+	EABKID  string
+	EABHMAC string
+	Root    string
+}
+
+func parseIssuer(s string) (*acmeIssuer, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty issuer")
+	}
+
+	issuer := &acmeIssuer{URL: fields[0]}
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q for issuer %s", option, issuer.URL)
+		}
+		switch kv[0] {
+		case "eab-kid":
+			issuer.EABKID = kv[1]
+		case "eab-hmac":
+			issuer.EABHMAC = kv[1]
+		case "root":
+			issuer.Root = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown option %q for issuer %s", kv[0], issuer.URL)
+		}
+	}
+
+	if (len(issuer.EABKID) > 0) != (len(issuer.EABHMAC) > 0) {
+		return nil, fmt.Errorf("issuer %s needs both eab-kid and eab-hmac", issuer.URL)
+	}
+	return issuer, nil
+}
+
+// getIssuers returns the issuers from ssl.auto.issuers, in order of
+// preference
+func getIssuers(ctx *cli.Context) []*acmeIssuer {
+	var issuers []*acmeIssuer
+	for _, s := range ctx.GlobalStringSlice("ssl.auto.issuers") {
+		issuer, err := parseIssuer(s)
+		if err != nil {
+			log.Fatalf("Invalid ssl.auto.issuers setting: %s", err.Error())
+		}
+		issuers = append(issuers, issuer)
+	}
+	return issuers
+}
+
+// acmeUser is the ACME account acmeproxy uses with an issuer
+type acmeUser struct {
+	Email        string
+	Registration *registration.Resource
+	key          crypto.PrivateKey
+}
+
+func (u *acmeUser) GetEmail() string                        { return u.Email }
+func (u *acmeUser) GetRegistration() *registration.Resource { return u.Registration }
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// issuerChain is a certmagic.Manager that tries the issuers in order
+// until one of them issues the certificate. All certificates are stored
+// under the first (primary) issuer, so certmagic finds them no matter
+// which issuer they came from.
+type issuerChain struct {
+	magic    *certmagic.Config
+	issuers  []*acmeIssuer
+	provider challenge.Provider
+
+	mu      sync.Mutex
+	clients map[string]*lego.Client
+}
+
+func newIssuerChain(magic *certmagic.Config, issuers []*acmeIssuer, provider challenge.Provider) *issuerChain {
+	return &issuerChain{
+		magic:    magic,
+		issuers:  issuers,
+		provider: provider,
+		clients:  make(map[string]*lego.Client),
+	}
+}
+
+// Obtain gets a certificate for name from the first issuer that works
+func (c *issuerChain) Obtain(name string) error {
+	return c.issue(name, "acme_cert_obtained")
+}
+
+// Renew gets a new certificate for name, which doesn't have to come from
+// the issuer of the current one
+func (c *issuerChain) Renew(name string) error {
+	return c.issue(name, "acme_cert_renewed")
+}
+
+// Revoke revokes the certificate for name with the issuer that accepts it
+func (c *issuerChain) Revoke(name string) error {
+	cert, err := c.magic.Storage.Load(certmagic.StorageKeys.SiteCert(c.magic.CA, name))
+	if err != nil {
+		return err
+	}
+
+	for _, issuer := range c.issuers {
+		client, err := c.client(issuer)
+		if err == nil {
+			err = client.Certificate.Revoke(cert)
+		}
+		if err != nil {
+			xlog.Warnf("[%s] Could not revoke certificate with %s: %v", name, issuer.URL, err)
+			continue
+		}
+		if c.magic.OnEvent != nil {
+			c.magic.OnEvent("acme_cert_revoked", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("no issuer could revoke the certificate for %s", name)
+}
+
+func (c *issuerChain) issue(name string, event string) error {
+	lockKey := "issue_cert_" + name
+	if err := c.magic.Storage.Lock(lockKey); err != nil {
+		return err
+	}
+	defer c.magic.Storage.Unlock(lockKey)
+
+	var errs []string
+	for _, issuer := range c.issuers {
+		res, err := c.obtain(issuer, name)
+		if err != nil {
+			xlog.Warnf("[%s] Could not get certificate from %s: %v", name, issuer.URL, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", issuer.URL, err))
+			continue
+		}
+
+		if err := c.save(res); err != nil {
+			return err
+		}
+		xlog.Infof("[%s] Certificate issued by %s", name, issuer.URL)
+		if c.magic.OnEvent != nil {
+			c.magic.OnEvent(event, name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no issuer could issue a certificate for %s (%s)", name, strings.Join(errs, "; "))
+}
+
+func (c *issuerChain) obtain(issuer *acmeIssuer, name string) (*certificate.Resource, error) {
+	client, err := c.client(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{name},
+		Bundle:  true,
+	})
+}
+
+// save stores the certificate like certmagic does, under the primary
+// issuer
+func (c *issuerChain) save(res *certificate.Resource) error {
+	meta, err := json.MarshalIndent(res, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	assets := map[string][]byte{
+		certmagic.StorageKeys.SiteCert(c.magic.CA, res.Domain):       res.Certificate,
+		certmagic.StorageKeys.SitePrivateKey(c.magic.CA, res.Domain): res.PrivateKey,
+		certmagic.StorageKeys.SiteMeta(c.magic.CA, res.Domain):       meta,
+	}
+	for key, value := range assets {
+		if err := c.magic.Storage.Store(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// client returns a lego client with a registered account for issuer
+func (c *issuerChain) client(issuer *acmeIssuer) (*lego.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[issuer.URL]; ok {
+		return client, nil
+	}
+
+	user, err := c.loadUser(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = issuer.URL
+	legoConfig.Certificate.KeyType = c.magic.KeyType
+	if len(issuer.Root) > 0 {
+		roots, err := loadRoots(issuer.Root)
+		if err != nil {
+			return nil, err
+		}
+		if transport, ok := legoConfig.HTTPClient.Transport.(*http.Transport); ok {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.RootCAs = roots
+		}
+	}
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Use the same DNS challenge options as certmagic
+	var options []dns01.ChallengeOption
+	if c.magic.DNSChallengeOption != nil {
+		options = append(options, c.magic.DNSChallengeOption)
+	}
+	if err := client.Challenge.SetDNS01Provider(c.provider, options...); err != nil {
+		return nil, err
+	}
+
+	if user.Registration == nil {
+		if len(issuer.EABKID) > 0 {
+			user.Registration, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: c.magic.Agreed,
+				Kid:                  issuer.EABKID,
+				HmacEncoded:          issuer.EABHMAC,
+			})
+		} else {
+			user.Registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: c.magic.Agreed})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := c.saveUser(issuer, user); err != nil {
+			return nil, err
+		}
+	}
+
+	c.clients[issuer.URL] = client
+	return client, nil
+}
+
+// loadUser loads the account for issuer from storage, or creates a new
+// (unregistered) one
+func (c *issuerChain) loadUser(issuer *acmeIssuer) (*acmeUser, error) {
+	user := &acmeUser{Email: c.magic.Email}
+
+	keyKey := certmagic.StorageKeys.UserPrivateKey(issuer.URL, user.Email)
+	if !c.magic.Storage.Exists(keyKey) {
+		key, err := certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		user.key = key
+		return user, err
+	}
+	keyPEM, err := c.magic.Storage.Load(keyKey)
+	if err != nil {
+		return nil, err
+	}
+	if user.key, err = certcrypto.ParsePEMPrivateKey(keyPEM); err != nil {
+		return nil, err
+	}
+
+	regKey := certmagic.StorageKeys.UserReg(issuer.URL, user.Email)
+	if !c.magic.Storage.Exists(regKey) {
+		return user, nil
+	}
+	reg, err := c.magic.Storage.Load(regKey)
+	if err != nil {
+		return nil, err
+	}
+	return user, json.Unmarshal(reg, user)
+}
+
+func (c *issuerChain) saveUser(issuer *acmeIssuer, user *acmeUser) error {
+	reg, err := json.MarshalIndent(user, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := c.magic.Storage.Store(certmagic.StorageKeys.UserPrivateKey(issuer.URL, user.Email), certcrypto.PEMEncode(user.key)); err != nil {
+		return err
+	}
+	return c.magic.Storage.Store(certmagic.StorageKeys.UserReg(issuer.URL, user.Email), reg)
+}
+
+// loadRoots returns the system roots plus the certificates in file
+func loadRoots(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return roots, nil
+}
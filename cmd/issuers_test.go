@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v3/certcrypto"
+	"github.com/go-acme/lego/v3/challenge/dns01"
+	"github.com/mholt/certmagic"
+	"github.com/miekg/dns"
+)
+
+// txtProvider is a DNS provider publishing its records in a local DNS
+// server for Pebble to validate
+type txtProvider struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (p *txtProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.records[strings.ToLower(fqdn)] = value
+	return nil
+}
+
+func (p *txtProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, _ := dns01.GetRecord(domain, keyAuth)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.records, strings.ToLower(fqdn))
+	return nil
+}
+
+// ServeDNS answers TXT queries with the presented records
+func (p *txtProvider) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range r.Question {
+		if q.Qtype != dns.TypeTXT {
+			continue
+		}
+		p.mu.Lock()
+		value, ok := p.records[strings.ToLower(q.Name)]
+		p.mu.Unlock()
+		if ok {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+				Txt: []string{value},
+			})
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// startDNS serves the records of provider on a local port, over UDP and
+// TCP
+func startDNS(t *testing.T, provider *txtProvider) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	udp := &dns.Server{PacketConn: pc, Handler: provider}
+	tcp := &dns.Server{Listener: l, Handler: provider}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	return pc.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 to
+// dir, for Pebble to serve its API with
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pebble"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeAddress returns a local TCP address that is free right now
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// pebble is a Pebble test CA running for a test
+type pebble struct {
+	directory  string
+	management string
+	cmd        *exec.Cmd
+}
+
+// testEABKey is a base64url encoded External Account Binding MAC key
+const testEABKey = "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W"
+
+// startPebble starts Pebble using the DNS server at dnsServer to
+// validate challenges, or skips the test when pebble isn't installed.
+// With eabKeys (key ID to base64url MAC key) Pebble requires External
+// Account Binding with one of them.
+func startPebble(t *testing.T, dir string, name string, dnsServer string, eabKeys map[string]string) *pebble {
+	path, err := exec.LookPath("pebble")
+	if err != nil {
+		t.Skip("pebble not found")
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	listen, management := freeAddress(t), freeAddress(t)
+	config, err := json.Marshal(map[string]interface{}{
+		"pebble": map[string]interface{}{
+			"listenAddress":                  listen,
+			"managementListenAddress":        management,
+			"certificate":                    certFile,
+			"privateKey":                     keyFile,
+			"httpPort":                       5002,
+			"tlsPort":                        5001,
+			"externalAccountBindingRequired": len(eabKeys) > 0,
+			"externalAccountMACKeys":         eabKeys,
+			"retryAfter":                     map[string]int{"authz": 1, "order": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, name+".json")
+	if err := ioutil.WriteFile(configFile, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pebble{
+		directory:  "https://" + listen + "/dir",
+		management: "https://" + management,
+		cmd:        exec.Command(path, "-config", configFile, "-dnsserver", dnsServer),
+	}
+	p.cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	if testing.Verbose() {
+		p.cmd.Stdout, p.cmd.Stderr = os.Stderr, os.Stderr
+	}
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := pebbleClient(t, certFile)
+	for i := 0; i < 100; i++ {
+		if resp, err := client.Get(p.directory); err == nil {
+			resp.Body.Close()
+			return p
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	p.stop()
+	t.Fatalf("pebble didn't start on %s", listen)
+	return nil
+}
+
+func (p *pebble) stop() {
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// pebbleClient returns an HTTP client trusting the certificate of Pebble
+func pebbleClient(t *testing.T, certFile string) *http.Client {
+	roots, err := loadRoots(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+}
+
+// intermediate returns the certificate Pebble issues certificates with
+func (p *pebble) intermediate(t *testing.T, client *http.Client) *x509.Certificate {
+	resp, err := client.Get(p.management + "/intermediates/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no intermediate certificate from %s", p.management)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// TestIssuerChainFailover checks that a certificate is obtained from the
+// next issuer when the first ones are unreachable or fail, and that it is
+// stored under the primary issuer
+func TestIssuerChainFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts pebble")
+	}
+
+	dir, err := ioutil.TempDir("", "acmeproxy-issuers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeTestCertificate(t, dir)
+
+	provider := &txtProvider{records: make(map[string]string)}
+	dnsServer, stopDNS := startDNS(t, provider)
+	defer stopDNS()
+
+	// The failing CA requires External Account Binding, which the issuer
+	// isn't configured with
+	failing := startPebble(t, dir, "failing", dnsServer, map[string]string{"other": testEABKey})
+	defer failing.stop()
+	working := startPebble(t, dir, "working", dnsServer, nil)
+	defer working.stop()
+
+	issuers := []*acmeIssuer{
+		{URL: "https://" + freeAddress(t) + "/dir", Root: certFile},
+		{URL: failing.directory, Root: certFile},
+		{URL: working.directory, Root: certFile},
+	}
+	storage := &certmagic.FileStorage{Path: filepath.Join(dir, "certmagic")}
+	var events []string
+	magic := &certmagic.Config{
+		CA:      issuers[0].URL,
+		Email:   "acmeproxy@example.com",
+		Agreed:  true,
+		KeyType: certcrypto.EC256,
+		Storage: storage,
+		// The records are only in the local DNS server
+		DNSChallengeOption: dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			return true, nil
+		}),
+		OnEvent: func(event string, data interface{}) {
+			events = append(events, fmt.Sprintf("%s %v", event, data))
+		},
+	}
+
+	name := "acmeproxy.example.com"
+	chain := newIssuerChain(magic, issuers, provider)
+	if err := chain.Obtain(name); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(events) != "[acme_cert_obtained "+name+"]" {
+		t.Errorf("events: got %v", events)
+	}
+
+	for _, key := range []string{
+		certmagic.StorageKeys.SiteCert(issuers[0].URL, name),
+		certmagic.StorageKeys.SitePrivateKey(issuers[0].URL, name),
+		certmagic.StorageKeys.SiteMeta(issuers[0].URL, name),
+	} {
+		if !storage.Exists(key) {
+			t.Errorf("%s not stored under the primary issuer", key)
+		}
+	}
+	if storage.Exists(certmagic.StorageKeys.SiteCert(issuers[2].URL, name)) {
+		t.Error("certificate stored under the issuer it came from")
+	}
+
+	certPEM, err := storage.Load(certmagic.StorageKeys.SiteCert(issuers[0].URL, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no certificate stored")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != name && (len(cert.DNSNames) == 0 || cert.DNSNames[0] != name) {
+		t.Errorf("certificate for %v, want %s", cert.DNSNames, name)
+	}
+
+	client := pebbleClient(t, certFile)
+	if err := cert.CheckSignatureFrom(working.intermediate(t, client)); err != nil {
+		t.Errorf("certificate not issued by the working CA: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(failing.intermediate(t, client)); err == nil {
+		t.Error("certificate issued by the failing CA")
+	}
+}
+
+// TestIssuerEAB checks that a certificate is obtained from a CA that
+// requires External Account Binding with the eab-kid and eab-hmac of the
+// issuer
+func TestIssuerEAB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts pebble")
+	}
+
+	dir, err := ioutil.TempDir("", "acmeproxy-issuers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, _ := writeTestCertificate(t, dir)
+
+	provider := &txtProvider{records: make(map[string]string)}
+	dnsServer, stopDNS := startDNS(t, provider)
+	defer stopDNS()
+
+	ca := startPebble(t, dir, "eab", dnsServer, map[string]string{"acmeproxy": testEABKey})
+	defer ca.stop()
+
+	issuer, err := parseIssuer(ca.directory + " eab-kid=acmeproxy eab-hmac=" + testEABKey + " root=" + certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &certmagic.FileStorage{Path: filepath.Join(dir, "certmagic")}
+	magic := &certmagic.Config{
+		CA:      issuer.URL,
+		Email:   "acmeproxy@example.com",
+		Agreed:  true,
+		KeyType: certcrypto.EC256,
+		Storage: storage,
+		DNSChallengeOption: dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			return true, nil
+		}),
+	}
+
+	name := "eab.example.com"
+	if err := newIssuerChain(magic, []*acmeIssuer{issuer}, provider).Obtain(name); err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, err := storage.Load(certmagic.StorageKeys.SiteCert(issuer.URL, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("no certificate stored")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(ca.intermediate(t, pebbleClient(t, certFile))); err != nil {
+		t.Errorf("certificate not issued by the EAB CA: %v", err)
+	}
+}
+
+func TestParseIssuer(t *testing.T) {
+	tests := []struct {
+		issuer string
+		want   acmeIssuer
+		err    bool
+	}{
+		{issuer: "https://ca.example.com/dir", want: acmeIssuer{URL: "https://ca.example.com/dir"}},
+		{
+			issuer: "https://ca.example.com/dir  eab-kid=kid eab-hmac=c2VjcmV0 root=/etc/acmeproxy/root.pem",
+			want:   acmeIssuer{URL: "https://ca.example.com/dir", EABKID: "kid", EABHMAC: "c2VjcmV0", Root: "/etc/acmeproxy/root.pem"},
+		},
+		// The MAC key may end with base64 padding
+		{issuer: "https://ca.example.com/dir eab-kid=kid eab-hmac=c2VjcmV0MQ==", want: acmeIssuer{URL: "https://ca.example.com/dir", EABKID: "kid", EABHMAC: "c2VjcmV0MQ=="}},
+		{issuer: "", err: true},
+		{issuer: "https://ca.example.com/dir eab-kid=kid", err: true},
+		{issuer: "https://ca.example.com/dir eab-hmac=c2VjcmV0", err: true},
+		{issuer: "https://ca.example.com/dir eab=kid", err: true},
+		{issuer: "https://ca.example.com/dir root", err: true},
+	}
+
+	for _, test := range tests {
+		issuer, err := parseIssuer(test.issuer)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", test.issuer, issuer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.issuer, err)
+		} else if *issuer != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.issuer, *issuer, test.want)
+		}
+	}
+}
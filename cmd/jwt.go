@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mdbraber/acmeproxy/acmeproxy"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// parseJWTIssuer parses a jwt.issuers entry, e.g.
+// "https://token.actions.githubusercontent.com audience=acmeproxy domains-claim=domains"
+func parseJWTIssuer(s string) (*acmeproxy.JWTIssuer, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty issuer")
+	}
+
+	issuer := &acmeproxy.JWTIssuer{Issuer: fields[0]}
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q for issuer %s", option, issuer.Issuer)
+		}
+		switch kv[0] {
+		case "jwks":
+			issuer.JWKS = kv[1]
+		case "audience":
+			issuer.Audience = strings.Split(kv[1], ",")
+		case "domains-claim":
+			issuer.DomainsClaim = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown option %q for issuer %s", kv[0], issuer.Issuer)
+		}
+	}
+
+	// Without an audience, tokens the issuer minted for any other service
+	// would be accepted
+	if len(issuer.Audience) == 0 {
+		return nil, fmt.Errorf("issuer %s needs an audience", issuer.Issuer)
+	}
+	return issuer, nil
+}
+
+// newJWTAuthenticator sets up bearer token authentication for the
+// jwt.issuers, or returns nil if there are none
+func newJWTAuthenticator(ctx *cli.Context) *acmeproxy.JWTAuthenticator {
+	var issuers []*acmeproxy.JWTIssuer
+	for _, s := range ctx.GlobalStringSlice("jwt.issuers") {
+		issuer, err := parseJWTIssuer(s)
+		if err != nil {
+			log.Fatalf("Invalid jwt.issuers setting: %s", err.Error())
+		}
+		issuers = append(issuers, issuer)
+	}
+	if len(issuers) == 0 {
+		return nil
+	}
+	return acmeproxy.NewJWTAuthenticator(issuers, time.Duration(ctx.GlobalInt("jwt.refresh-interval"))*time.Second)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// CreateQuotasCommand creates the quotas command, which reads the
+// counters from the state store of the server directly (using the server
+// settings from --config-file)
+func CreateQuotasCommand() cli.Command {
+	return cli.Command{
+		Name:  "quotas",
+		Usage: "Show the use of the quota.names and quota.presents quotas (needs a shared state store: file or redis)",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the use of the quotas in their current windows",
+				Action: listQuotas,
+			},
+		},
+	}
+}
+
+func listQuotas(ctx *cli.Context) error {
+	store := newStateStore(ctx)
+	defer store.Close()
+
+	usage, err := newQuotas(ctx, store).Usage()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to list quota usage: %v", err), ExitServerError)
+	}
+	for _, u := range usage {
+		fmt.Printf("%s\t%s\t%d/%d\tresets %s\n", u.Quota, u.Subject, u.Used, u.Limit, u.Reset.Local().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -7,5 +7,7 @@ import (
 
 func Run(ctx *cli.Context) {
 	config := getConfig(ctx)
+	go watchIPFilters(ctx, config)
+	acmeproxy.RunJobs(config)
 	acmeproxy.RunServer(ctx, config)
 }
@@ -3,7 +3,7 @@ package cmd
 import (
 	"crypto/tls"
 	golog "log"
-	//"net"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -11,18 +11,22 @@ import (
 	"time"
 
 	"github.com/mdbraber/acmeproxy/acmeproxy"
+	"github.com/mdbraber/acmeproxy/acmeproxy/client"
 	aplog "github.com/mdbraber/acmeproxy/log"
-	"github.com/mholt/certmagic"
+	"github.com/mdbraber/acmeproxy/state"
 	log "github.com/sirupsen/logrus"
 	"github.com/go-acme/lego/v3/certcrypto"
-	xlog "github.com/go-acme/lego/v3/log"
+	"github.com/go-acme/lego/v3/challenge"
 	"github.com/go-acme/lego/v3/providers/dns"
 	"gopkg.in/urfave/cli.v1"
 )
 
 const (
+	SSLModeNone   string = "none"
 	SSLModeManual string = "manual"
 	SSLModeAuto   string = "auto"
+
+	ProviderUpstream string = "acmeproxy-upstream"
 )
 
 func getConfig(ctx *cli.Context) *acmeproxy.Config {
@@ -45,16 +49,11 @@ func getConfig(ctx *cli.Context) *acmeproxy.Config {
 	}
 
 	// Check if we can get a valid DNS provider (if the right environment variables are set)
-	provider, err := dns.NewDNSChallengeProviderByName(ctx.GlobalString("provider"))
+	provider, err := newDNSProvider(ctx.GlobalString("provider"))
 	if err != nil {
 		log.Fatalf("Unable to setup a valid DNS provider: %s", err.Error())
 	}
 
-	// Check SSL settings
-	if ctx.GlobalString("ssl") == SSLModeManual && (len(ctx.GlobalString("ssl.manual.cert-file")) == 0 || len(ctx.GlobalString("ssl.manual.key-file")) == 0) {
-		log.Fatal("When using --ssl/-s please specify your own certificate/key files with --ssl.manual.cert-file and --ssl.manual.key-file")
-	}
-
 	// Set certmagic variables
 	if len(ctx.GlobalString("ssl.auto.provider")) == 0 {
 		err := ctx.GlobalSet("ssl.auto.provider", ctx.GlobalString("provider"))
@@ -63,6 +62,9 @@ func getConfig(ctx *cli.Context) *acmeproxy.Config {
 		}
 	}
 
+	// Setup the state store
+	store := newStateStore(ctx)
+
 	// Debug flag names
 	for _, flagName := range ctx.GlobalFlagNames() {
 		log.WithField(flagName, ctx.GlobalString(flagName)).Debug("Using flag")
@@ -73,18 +75,135 @@ func getConfig(ctx *cli.Context) *acmeproxy.Config {
 	config.Provider = provider
 	config.ProviderName = ctx.GlobalString("provider")
 	config.AllowedIPs = ctx.GlobalStringSlice("allowed-ips")
+	ipFilters, err := newIPFilters(func(name string) ([]string, error) {
+		return ctx.GlobalStringSlice(name), nil
+	})
+	if err != nil {
+		log.Fatalf("Invalid IP filter setting: %s", err.Error())
+	}
+	config.SetIPFilters(ipFilters)
+	config.TrustedProxies, err = acmeproxy.ParseCIDRs(ctx.GlobalStringSlice("trusted-proxies"))
+	if err != nil {
+		log.Fatalf("Invalid trusted-proxies setting: %s", err.Error())
+	}
 	config.AllowedDomains = ctx.GlobalStringSlice("allowed-domains")
 	config.HtpasswdFile = ctx.GlobalString("htpasswd-file")
 	config.AccesslogFile = ctx.GlobalString("accesslog-file")
+	config.AuditlogFile = ctx.GlobalString("auditlog-file")
+	config.AdminUsers = ctx.GlobalStringSlice("admin-users")
+	config.AllowedUIDs = ctx.GlobalStringSlice("allowed-uids")
+	config.State = store
+	config.RecordMaxAge = time.Duration(ctx.GlobalInt("records.max-age")) * time.Second
+	config.JWT = newJWTAuthenticator(ctx)
+	if file := ctx.GlobalString("hmac-keys-file"); len(file) > 0 {
+		config.HMAC, err = acmeproxy.NewHMACAuthenticator(file, time.Duration(ctx.GlobalInt("hmac.max-skew"))*time.Second, store)
+		if err != nil {
+			log.Fatalf("Unable to load hmac-keys-file: %s", err.Error())
+		}
+	}
+	if file := ctx.GlobalString("ssh-known-hosts-file"); len(file) > 0 {
+		config.SSH, err = acmeproxy.NewSSHAuthenticator(file, time.Duration(ctx.GlobalInt("ssh.max-skew"))*time.Second, store)
+		if err != nil {
+			log.Fatalf("Unable to load ssh-known-hosts-file: %s", err.Error())
+		}
+	}
+	config.Wildcards = newWildcardPolicy(ctx)
+	if ctx.GlobalBool("dns-binding") {
+		config.DNSBinding, err = acmeproxy.NewDNSBinding(ctx.GlobalStringSlice("dns-binding.resolvers"), time.Duration(ctx.GlobalInt("dns-binding.timeout"))*time.Second)
+		if err != nil {
+			log.Fatalf("Invalid dns-binding.resolvers setting: %s", err.Error())
+		}
+	}
+	if ctx.GlobalInt("lockout.threshold") > 0 {
+		config.Lockout = newLockout(ctx, store)
+	}
+	if ctx.GlobalBool("approval.required") {
+		config.Approvals = newApprovals(ctx, store)
+	}
+	if ctx.GlobalInt("quota.names") > 0 || ctx.GlobalInt("quota.presents") > 0 {
+		config.Quotas = newQuotas(ctx, store)
+	}
 
-	config.HttpServer = newHttpServer(ctx)
-	// FIXME This is sort of weird... (using config in a config)
-	// this should be done by newHttpServer:
-	config.HttpServer.Handler = acmeproxy.GetHandler(config)
+	config.Listeners, config.CertificateSources = newListeners(ctx)
+	// Every listener serves with this handler; requests on unix sockets
+	// carry the peer credentials in their context
+	config.HttpServer = &http.Server{
+		Handler:     acmeproxy.GetHandler(config),
+		ConnContext: acmeproxy.ConnContext,
+	}
 
 	return config
 }
 
+// newStateStore sets up the state store from the state settings
+func newStateStore(ctx *cli.Context) state.Store {
+	store, err := state.New(&state.Config{
+		Type:          ctx.GlobalString("state"),
+		Path:          ctx.GlobalString("state.path"),
+		RedisAddress:  ctx.GlobalString("state.redis.address"),
+		RedisPassword: ctx.GlobalString("state.redis.password"),
+		RedisDB:       ctx.GlobalInt("state.redis.db"),
+		RedisPrefix:   ctx.GlobalString("state.redis.prefix"),
+	})
+	if err != nil {
+		log.Fatalf("Unable to setup state store (%s): %s", ctx.GlobalString("state"), err.Error())
+	}
+	return store
+}
+
+// newLockout sets up the lockout from the lockout settings
+func newLockout(ctx *cli.Context, store state.Store) *acmeproxy.Lockout {
+	return acmeproxy.NewLockout(store, int64(ctx.GlobalInt("lockout.threshold")),
+		time.Duration(ctx.GlobalInt("lockout.window"))*time.Second,
+		time.Duration(ctx.GlobalInt("lockout.ban-time"))*time.Second,
+		time.Duration(ctx.GlobalInt("lockout.max-ban-time"))*time.Second)
+}
+
+// newApprovals sets up the approvals from the approval settings
+func newApprovals(ctx *cli.Context, store state.Store) *acmeproxy.Approvals {
+	return acmeproxy.NewApprovals(store,
+		time.Duration(ctx.GlobalInt("approval.ttl"))*time.Second,
+		time.Duration(ctx.GlobalInt("approval.pending-ttl"))*time.Second,
+		ctx.GlobalString("approval.notify-url"))
+}
+
+// newQuotas sets up the quotas from the quota settings
+func newQuotas(ctx *cli.Context, store state.Store) *acmeproxy.Quotas {
+	for _, window := range []string{"quota.names-window", "quota.presents-window"} {
+		if ctx.GlobalInt(window) <= 0 {
+			log.Fatalf("Invalid %s setting: must be more than 0 seconds", window)
+		}
+	}
+	return acmeproxy.NewQuotas(store,
+		acmeproxy.Quota{
+			Limit:  int64(ctx.GlobalInt("quota.names")),
+			Window: time.Duration(ctx.GlobalInt("quota.names-window")) * time.Second,
+		},
+		acmeproxy.Quota{
+			Limit:  int64(ctx.GlobalInt("quota.presents")),
+			Window: time.Duration(ctx.GlobalInt("quota.presents-window")) * time.Second,
+		})
+}
+
+// newDNSProvider returns the lego DNS provider with the given name, or a
+// client for an upstream acmeproxy (configured with the ACMEPROXY_*
+// environment variables) for acmeproxy-upstream
+func newDNSProvider(name string) (challenge.Provider, error) {
+	if name != ProviderUpstream {
+		return dns.NewDNSChallengeProviderByName(name)
+	}
+
+	config, err := client.NewConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	// Forward raw mode requests as they are, unless configured otherwise
+	if len(os.Getenv("ACMEPROXY_MODE")) == 0 {
+		config.Mode = client.ModeRaw
+	}
+	return client.New(config)
+}
+
 func setupLogging(ctx *cli.Context) {
 	// Setup logging
 	tf := new(aplog.TextFormatter)
@@ -120,83 +239,122 @@ func setupLogging(ctx *cli.Context) {
 	golog.SetOutput(logger.Writer())
 }
 
-func newHttpServer(ctx *cli.Context) *http.Server {
+// tlsConfigs sets up the TLS configuration for each ssl mode the
+// listeners use, once per mode
+type tlsConfigs struct {
+	ctx     *cli.Context
+	configs map[string]*tls.Config
+	sources []acmeproxy.CertificateSource
+}
 
-	port := strconv.Itoa(ctx.GlobalInt("port"))
-	//host, err := net.LookupHost(ctx.GlobalString("interface"))
-	//if err != nil {
-	//	log.Fatalf("Can't find IP for interface %s - not in DNS?", ctx.GlobalString("interface"))
-	//}
+func newTLSConfigs(ctx *cli.Context) *tlsConfigs {
+	return &tlsConfigs{ctx: ctx, configs: make(map[string]*tls.Config)}
+}
 
-	var server = &http.Server{
-		//Addr: net.JoinHostPort(host[0], port),
-		Addr: ":" + port,
+// get returns the TLS configuration for mode, nil for plain HTTP
+func (t *tlsConfigs) get(mode string) *tls.Config {
+	if mode == "" || mode == SSLModeNone {
+		return nil
+	}
+	if tlsConfig, ok := t.configs[mode]; ok {
+		return tlsConfig
 	}
 
-	switch ctx.GlobalString("ssl") {
+	var tlsConfig *tls.Config
+	switch mode {
 	case SSLModeManual:
-		log.Info("Setting up server using SSL (manual)")
-		tlsConfig := &tls.Config{
-			MinVersion:               tls.VersionTLS12,
+		reloader := newCertReloader(t.ctx)
+		tlsConfig = &tls.Config{
 			PreferServerCipherSuites: true,
-			//FIXME: other options?
+			GetCertificate:           reloader.GetCertificate,
 		}
+		t.sources = append(t.sources, reloader)
+	case SSLModeAuto:
+		var managed *managedCertificates
+		tlsConfig, managed = newAutoTLSConfig(t.ctx)
+		t.sources = append(t.sources, managed)
+	default:
+		log.Fatalf("Unsupported ssl mode: %s (supported: none, manual or auto)", mode)
+	}
+	applyTLSSettings(t.ctx, tlsConfig)
+	t.configs[mode] = tlsConfig
+	return tlsConfig
+}
 
-		tlsCert, err := tls.LoadX509KeyPair(ctx.GlobalString("ssl.manual.cert-file"), ctx.GlobalString("ssl.manual.key-file"))
-		if err != nil {
-			if os.IsNotExist(err) {
-				log.Fatalf("Could not load X509 key pair (cert: %q, key: %q): %v", ctx.GlobalString("ssl.manual.cert-file"), ctx.GlobalString("ssl.manual.key-file"), err)
-			}
-			log.Fatalf("Error reading X509 key pair (cert: %q, key: %q): %v. Make sure the key is not encrypted.", ctx.GlobalString("ssl.manual.cert-file"), ctx.GlobalString("ssl.manual.key-file"), err)
+// newCertReloader loads the ssl.manual certificate and watches it for
+// changes
+func newCertReloader(ctx *cli.Context) *acmeproxy.CertReloader {
+	certFile, keyFile := ctx.GlobalString("ssl.manual.cert-file"), ctx.GlobalString("ssl.manual.key-file")
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		log.Fatal("When using --ssl/-s please specify your own certificate/key files with --ssl.manual.cert-file and --ssl.manual.key-file")
+	}
+
+	log.Info("Setting up server using SSL (manual)")
+	reloader, err := acmeproxy.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Fatalf("Could not load X509 key pair (cert: %q, key: %q): %v", certFile, keyFile, err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{tlsCert}
-		server.TLSConfig = tlsConfig
-	case SSLModeAuto:
-		log.Info("Setting up server using SSL (certmagic)")
+		log.Fatalf("Error reading X509 key pair (cert: %q, key: %q): %v. Make sure the key is not encrypted.", certFile, keyFile, err)
+	}
+
+	if interval := ctx.GlobalInt("ssl.manual.reload-interval"); interval > 0 {
+		go reloader.Watch(time.Duration(interval)*time.Second, nil)
+	}
+	return reloader
+}
+
+// newListeners opens the sockets from the listen setting, or the
+// addresses interface resolves to (with port) if there are none. Every
+// listener uses the TLS mode from its ssl= option, or the ssl setting;
+// unix sockets use plain HTTP unless ssl= is set. TCP listeners accept
+// PROXY protocol headers from the proxy-protocol upstreams, unless
+// proxy-protocol=off is set.
+func newListeners(ctx *cli.Context) ([]*acmeproxy.Listener, []acmeproxy.CertificateSource) {
+	entries := ctx.GlobalStringSlice("listen")
+	if len(entries) == 0 {
+		entries = []string{net.JoinHostPort(ctx.GlobalString("interface"), strconv.Itoa(ctx.GlobalInt("port")))}
+	}
 
-		salog := log.WithField("prefix", "ssl.auto")
-		xlog.Logger = salog
+	tlsConfigs := newTLSConfigs(ctx)
 
-		cmProvider, err := dns.NewDNSChallengeProviderByName(ctx.GlobalString("ssl.auto.provider"))
+	proxyUpstreams, err := acmeproxy.ParseCIDRs(ctx.GlobalStringSlice("proxy-protocol"))
+	if err != nil {
+		log.Fatalf("Invalid proxy-protocol setting: %s", err.Error())
+	}
+
+	var listeners []*acmeproxy.Listener
+	for _, entry := range entries {
+		la, err := acmeproxy.ParseListenAddress(entry)
 		if err != nil {
-			salog.WithField("error", err.Error()).Fatal("Unable to connect to a valid DNS provider for ssl.auto")
+			log.Fatalf("Invalid listen setting: %s", err.Error())
 		}
 
-		// FIXME check for errors with FileStorage?
-		certmagic.Default.Storage = &certmagic.FileStorage{Path: ctx.GlobalString("ssl.auto.path")}
-
-		cache := certmagic.NewCache(certmagic.CacheOptions{
-			GetConfigForCert: func(cert certmagic.Certificate) (certmagic.Config, error) {
-				// do whatever you need to do to get the right
-				// configuration for this certificate; keep in
-				// mind that this config value is used as a
-				// template, and will be completed with any
-				// defaults that are set in the Default config
-				return certmagic.Config{}, nil
-			},
-		})
-
-		magic := certmagic.New(cache, certmagic.Config{
-			CA: ctx.GlobalString("ssl.auto.ca"),
-			Email: getEmail(ctx),
-			Agreed: ctx.GlobalBool("ssl.auto.agreed"),
-			KeyType: getKeyType(ctx),
-			DNSProvider: cmProvider,
-			DisableHTTPChallenge: true,
-			DisableTLSALPNChallenge: true,
-		})
+		ls, err := la.Listen()
+		if err != nil {
+			log.Fatalf("Unable to listen on %s: %s", la, err.Error())
+		}
 
-		magicErr := magic.ManageSync([]string{ctx.GlobalString("interface")})
-		if magicErr != nil {
-			salog.WithField("error", magicErr.Error()).Fatal("Problem setting up certificates for ssl.auto")
+		for _, l := range ls {
+			listener := &acmeproxy.Listener{Listener: l, Name: l.Addr().String()}
+			mode, ok := la.Options["ssl"]
+			if l.Addr().Network() == acmeproxy.NetworkUnix {
+				listener.Name = acmeproxy.NetworkUnix + ":" + l.Addr().String()
+			} else {
+				if !ok {
+					mode = ctx.GlobalString("ssl")
+				}
+				// PROXY protocol headers are read before TLS
+				if len(proxyUpstreams) > 0 && la.Options["proxy-protocol"] != "off" {
+					listener.Listener = acmeproxy.NewProxyProtocolListener(l, proxyUpstreams)
+				}
+			}
+			listener.TLSConfig = tlsConfigs.get(mode)
+			listeners = append(listeners, listener)
 		}
-		server.TLSConfig = magic.TLSConfig()
-	default:
-		log.Info("Setting up server (HTTP)")
 	}
 
-	return server
-
+	return listeners, tlsConfigs.sources
 }
 
 // getKeyType the type from which private keys should be generated
@@ -226,3 +384,26 @@ func getEmail(ctx *cli.Context) string {
 	}
 	return email
 }
+
+// newWildcardPolicy returns the wildcard.rules, or nil when wildcards are
+// allowed for everyone
+func newWildcardPolicy(ctx *cli.Context) *acmeproxy.WildcardPolicy {
+	rules := ctx.GlobalStringSlice("wildcard.rules")
+	var defaultAllow bool
+	switch ctx.GlobalString("wildcard.default") {
+	case "allow":
+		defaultAllow = true
+	case "deny":
+	default:
+		log.Fatalf("Invalid wildcard.default setting: %s (expected allow or deny)", ctx.GlobalString("wildcard.default"))
+	}
+	if len(rules) == 0 && defaultAllow {
+		return nil
+	}
+
+	policy, err := acmeproxy.NewWildcardPolicy(rules, defaultAllow)
+	if err != nil {
+		log.Fatalf("Invalid wildcard.rules setting: %s", err.Error())
+	}
+	return policy
+}
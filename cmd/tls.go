@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// tlsVersions are the supported values for ssl.min-version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites are the supported values for ssl.cipher-suites (TLS 1.2
+// and lower, TLS 1.3 suites are not configurable)
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// tlsCurves are the supported values for ssl.curves
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// applyTLSSettings sets the minimum version, cipher suites and curves
+// from the ssl.* settings on tlsConfig
+func applyTLSSettings(ctx *cli.Context, tlsConfig *tls.Config) {
+	version, ok := tlsVersions[ctx.GlobalString("ssl.min-version")]
+	if !ok {
+		log.Fatalf("Unsupported TLS version: %s (supported: 1.0, 1.1, 1.2 or 1.3)", ctx.GlobalString("ssl.min-version"))
+	}
+	tlsConfig.MinVersion = version
+
+	if names := ctx.GlobalStringSlice("ssl.cipher-suites"); len(names) > 0 {
+		tlsConfig.CipherSuites = nil
+		for _, name := range names {
+			suite, ok := tlsCipherSuites[strings.ToUpper(name)]
+			if !ok {
+				log.Fatalf("Unsupported cipher suite: %s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite)
+		}
+		tlsConfig.PreferServerCipherSuites = true
+	}
+
+	if names := ctx.GlobalStringSlice("ssl.curves"); len(names) > 0 {
+		tlsConfig.CurvePreferences = nil
+		for _, name := range names {
+			curve, ok := tlsCurves[strings.ToUpper(strings.Replace(name, "-", "", 1))]
+			if !ok {
+				log.Fatalf("Unsupported curve: %s (supported: X25519, P256, P384 or P521)", name)
+			}
+			tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileEntry is the format values are stored in on disk
+type fileEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// FileStore keeps state in files below a directory. Access is serialized
+// with file locks, so several instances can share the directory (e.g. on
+// a shared volume that supports flock).
+type FileStore struct {
+	path string
+	done chan struct{}
+}
+
+// NewFileStore returns a FileStore keeping its files in path
+func NewFileStore(path string) (*FileStore, error) {
+	for _, dir := range []string{path, filepath.Join(path, "data"), filepath.Join(path, "locks")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &FileStore{path: path, done: make(chan struct{})}
+	go s.expire(time.Minute)
+	return s, nil
+}
+
+func (s *FileStore) file(key string) string {
+	return filepath.Join(s.path, "data", url.PathEscape(key))
+}
+
+// lock takes the lock serializing all modifications in the store
+func (s *FileStore) lock() (func(), error) {
+	return flockFile(filepath.Join(s.path, "store.lock"))
+}
+
+func (s *FileStore) read(key string) (*fileEntry, error) {
+	data, err := ioutil.ReadFile(s.file(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	e := &fileEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	if expired(e.Expires) {
+		return nil, ErrNotFound
+	}
+	return e, nil
+}
+
+// write atomically replaces the file for key
+func (s *FileStore) write(key string, e *fileEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.path, "data"), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file(key))
+}
+
+func (s *FileStore) Get(key string) ([]byte, error) {
+	e, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+func (s *FileStore) Put(key string, value []byte, ttl time.Duration) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.write(key, &fileEntry{Value: value, Expires: expiry(ttl)})
+}
+
+func (s *FileStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if _, err := s.read(key); err == nil {
+		return false, nil
+	} else if err != ErrNotFound {
+		return false, err
+	}
+	return true, s.write(key, &fileEntry{Value: value, Expires: expiry(ttl)})
+}
+
+func (s *FileStore) Delete(key string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(s.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) List(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.path, "data"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, f := range files {
+		key, err := url.PathUnescape(f.Name())
+		if err != nil || strings.HasPrefix(f.Name(), ".tmp-") || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, err := s.read(key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *FileStore) Incr(key string, ttl time.Duration) (int64, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	e, err := s.read(key)
+	if err == ErrNotFound {
+		e = &fileEntry{Expires: expiry(ttl)}
+	} else if err != nil {
+		return 0, err
+	}
+
+	n, _ := strconv.ParseInt(string(e.Value), 10, 64)
+	n++
+	e.Value = []byte(strconv.FormatInt(n, 10))
+	return n, s.write(key, e)
+}
+
+func (s *FileStore) Lock(name string) (func(), error) {
+	return flockFile(filepath.Join(s.path, "locks", url.PathEscape(name)+".lock"))
+}
+
+// expire periodically removes expired entries from disk
+func (s *FileStore) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(s.path, "data"))
+		if err != nil {
+			continue
+		}
+		unlock, err := s.lock()
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			key, err := url.PathUnescape(f.Name())
+			if err != nil || strings.HasPrefix(f.Name(), ".tmp-") {
+				continue
+			}
+			if _, err := s.read(key); err == ErrNotFound {
+				os.Remove(s.file(key))
+			}
+		}
+		unlock()
+	}
+}
+
+func (s *FileStore) Close() error {
+	close(s.done)
+	return nil
+}
@@ -0,0 +1,8 @@
+package state
+
+import "errors"
+
+// flockFile is not supported on Windows
+func flockFile(file string) (func(), error) {
+	return nil, errors.New("file locking is not supported on windows")
+}
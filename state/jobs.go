@@ -0,0 +1,21 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// instance identifies this process in the claims it stores for jobs
+var instance = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}()
+
+// ClaimJob claims the run of the periodic job name for the interval
+// containing now. When several instances share the store, only the first
+// one to claim a run gets true, so each run happens on one instance.
+func ClaimJob(store Store, name string, interval time.Duration, now time.Time) (bool, error) {
+	run := now.Truncate(interval).Unix()
+	return store.Add(fmt.Sprintf("jobs/%s/%d", name, run), []byte(instance), 2*interval)
+}
@@ -0,0 +1,117 @@
+package state
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore keeps state in memory, it can't be shared between instances
+// and doesn't survive a restart
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	locks   map[string]*sync.Mutex
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]memoryEntry),
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+// get returns the entry for key, removing it if it expired. The caller
+// must hold s.mu.
+func (s *MemoryStore) get(key string) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && expired(e.expires) {
+		delete(s.entries, key)
+		return e, false
+	}
+	return e, ok
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return e.value, nil
+}
+
+func (s *MemoryStore) Put(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+	s.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.entries {
+		if _, ok := s.get(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key)
+	if !ok {
+		e = memoryEntry{expires: expiry(ttl)}
+	}
+	n, _ := strconv.ParseInt(string(e.value), 10, 64)
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	s.entries[key] = e
+	return n, nil
+}
+
+func (s *MemoryStore) Lock(name string) (func(), error) {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[name] = l
+	}
+	s.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,294 @@
+package state
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisLockTTL bounds how long a lock survives an instance that died
+	// while holding it
+	redisLockTTL = 5 * time.Minute
+	// redisLockRetry is the interval to poll for a lock that is held
+	redisLockRetry = 100 * time.Millisecond
+)
+
+// Scripts that need to run atomically on the server
+const (
+	redisIncrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`
+	redisUnlockScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore keeps state in Redis (or any server speaking the Redis
+// protocol), which all instances connect to
+type RedisStore struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewRedisStore connects to the Redis server at address (host:port, or a
+// path for a unix socket). All keys are prefixed with prefix.
+func NewRedisStore(address string, password string, db int, prefix string) (*RedisStore, error) {
+	if address == "" {
+		return nil, errors.New("redis address is missing")
+	}
+
+	s := &RedisStore{address: address, password: password, db: db, prefix: prefix}
+	if _, err := s.do("PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect (re)establishes the connection. The caller must hold s.mu.
+func (s *RedisStore) connect() error {
+	network := "tcp"
+	if strings.HasPrefix(s.address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.rd = bufio.NewReader(conn)
+
+	if s.password != "" {
+		if _, err := s.command("AUTH", s.password); err != nil {
+			s.close()
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.command("SELECT", strconv.Itoa(s.db)); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// do runs a command, reconnecting once if the connection was lost
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := s.command(args...)
+		if _, ok := err.(redisError); err == nil || ok || attempt > 0 {
+			return reply, err
+		}
+		s.close()
+	}
+}
+
+// command sends a single command and reads its reply. The caller must
+// hold s.mu.
+func (s *RedisStore) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	s.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return s.reply()
+}
+
+// reply reads a single RESP reply
+func (s *RedisStore) reply() (interface{}, error) {
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(s.rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = s.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply type %q", kind)
+}
+
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// set runs SET with the given options and reports whether the key was set
+func (s *RedisStore) set(key string, value []byte, ttl time.Duration, options ...string) (bool, error) {
+	args := []string{"SET", s.prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	reply, err := s.do(append(args, options...)...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+func (s *RedisStore) Put(key string, value []byte, ttl time.Duration) error {
+	_, err := s.set(key, value, ttl)
+	return err
+}
+
+func (s *RedisStore) Add(key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.set(key, value, ttl, "NX")
+}
+
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+func (s *RedisStore) List(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", redisEscape(s.prefix+prefix)+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, errors.New("redis: invalid SCAN reply")
+		}
+		next, _ := items[0].([]byte)
+		found, _ := items[1].([]interface{})
+		for _, k := range found {
+			if key, ok := k.([]byte); ok {
+				keys = append(keys, strings.TrimPrefix(string(key), s.prefix))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	reply, err := s.do("EVAL", redisIncrScript, "1", s.prefix+key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errors.New("redis: invalid INCR reply")
+	}
+	return n, nil
+}
+
+func (s *RedisStore) Lock(name string) (func(), error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	value := hex.EncodeToString(token)
+	key := "locks/" + name
+
+	for {
+		ok, err := s.Add(key, []byte(value), redisLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		time.Sleep(redisLockRetry)
+	}
+
+	return func() {
+		s.do("EVAL", redisUnlockScript, "1", s.prefix+key, value)
+	}, nil
+}
+
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+	return nil
+}
+
+// redisEscape escapes the glob characters used by SCAN MATCH
+func redisEscape(pattern string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return r.Replace(pattern)
+}
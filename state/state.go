@@ -0,0 +1,79 @@
+// Package state provides the stores acmeproxy keeps its shared state in:
+// outstanding records, counters and locks. Running several acmeproxy
+// instances behind a load balancer requires a store they can all reach,
+// i.e. the file store on a shared volume or the Redis store.
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	TypeMemory string = "memory"
+	TypeFile   string = "file"
+	TypeRedis  string = "redis"
+)
+
+// ErrNotFound is returned by Get when a key does not exist
+var ErrNotFound = errors.New("key not found")
+
+// Store keeps state that has to be shared between acmeproxy instances
+type Store interface {
+	// Get returns the value stored for key, or ErrNotFound
+	Get(key string) ([]byte, error)
+	// Put stores value for key. A ttl of zero means the key doesn't expire.
+	Put(key string, value []byte, ttl time.Duration) error
+	// Add stores value for key only if key doesn't exist yet, and
+	// reports whether it was stored
+	Add(key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes key, it is not an error if key doesn't exist
+	Delete(key string) error
+	// List returns all keys starting with prefix
+	List(prefix string) ([]string, error)
+	// Incr increments the counter stored at key and returns its new
+	// value. The ttl is set when the counter is created.
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Lock waits for and obtains an exclusive lock on name, which is
+	// held until the returned function is called
+	Lock(name string) (func(), error)
+	// Close releases all resources held by the store
+	Close() error
+}
+
+// Config is used to configure a Store
+type Config struct {
+	Type          string
+	Path          string
+	RedisAddress  string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+}
+
+// New returns the Store configured by config
+func New(config *Config) (Store, error) {
+	switch config.Type {
+	case "", TypeMemory:
+		return NewMemoryStore(), nil
+	case TypeFile:
+		return NewFileStore(config.Path)
+	case TypeRedis:
+		return NewRedisStore(config.RedisAddress, config.RedisPassword, config.RedisDB, config.RedisPrefix)
+	}
+	return nil, fmt.Errorf("unknown state store %s", config.Type)
+}
+
+// expiry returns the time a value stored with ttl expires (zero for never)
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// expired reports whether a value expiring at expires has expired
+func expired(expires time.Time) bool {
+	return !expires.IsZero() && time.Now().After(expires)
+}
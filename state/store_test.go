@@ -0,0 +1,387 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores runs test against every store type. newStore may be called
+// several times, the stores it returns share their state, like instances
+// sharing a directory or Redis server.
+func testStores(t *testing.T, test func(t *testing.T, newStore func() Store)) {
+	t.Run("memory", func(t *testing.T) {
+		store := NewMemoryStore()
+		test(t, func() Store { return store })
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		var stores []Store
+		defer func() { closeStores(stores) }()
+		test(t, func() Store {
+			store, err := NewFileStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores = append(stores, store)
+			return store
+		})
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		address, stop := startRedis(t)
+		defer stop()
+
+		var stores []Store
+		defer func() { closeStores(stores) }()
+		test(t, func() Store {
+			store, err := NewRedisStore(address, "", 0, "test:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores = append(stores, store)
+			return store
+		})
+	})
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "acmeproxy-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func closeStores(stores []Store) {
+	for _, store := range stores {
+		store.Close()
+	}
+}
+
+// startRedis starts a redis-server on a free port for the test, or skips
+// the test when redis-server isn't installed
+func startRedis(t *testing.T) (string, func()) {
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	_, port, _ := net.SplitHostPort(address)
+	l.Close()
+
+	dir := tempDir(t)
+	cmd := exec.Command(path, "--port", port, "--bind", "127.0.0.1", "--save", "", "--appendonly", "no", "--dir", dir)
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			return address, stop
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	t.Fatalf("redis-server didn't start on %s", address)
+	return "", nil
+}
+
+func TestStoreGetPut(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		a, b := newStore(), newStore()
+
+		if _, err := a.Get("missing"); err != ErrNotFound {
+			t.Fatalf("Get of a missing key: got %v, want %v", err, ErrNotFound)
+		}
+		if err := a.Put("records/example.com", []byte("one"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Put("records/example.com", []byte("two"), 0); err != nil {
+			t.Fatal(err)
+		}
+		value, err := b.Get("records/example.com")
+		if err != nil || string(value) != "two" {
+			t.Fatalf("Get: got %q, %v, want %q", value, err, "two")
+		}
+
+		if err := b.Delete("records/example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Get("records/example.com"); err != ErrNotFound {
+			t.Fatalf("Get after Delete: got %v, want %v", err, ErrNotFound)
+		}
+		if err := a.Delete("records/example.com"); err != nil {
+			t.Fatalf("Delete of a missing key: %v", err)
+		}
+	})
+}
+
+func TestStoreAdd(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		a, b := newStore(), newStore()
+
+		if ok, err := a.Add("nonces/x", []byte("a"), 0); err != nil || !ok {
+			t.Fatalf("first Add: got %v, %v, want true", ok, err)
+		}
+		if ok, err := b.Add("nonces/x", []byte("b"), 0); err != nil || ok {
+			t.Fatalf("second Add: got %v, %v, want false", ok, err)
+		}
+		if value, _ := a.Get("nonces/x"); string(value) != "a" {
+			t.Fatalf("second Add replaced the value with %q", value)
+		}
+	})
+}
+
+func TestStoreAddConcurrent(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		added := 0
+		for i := 0; i < 10; i++ {
+			store := newStore()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := store.Add("nonces/race", []byte("x"), time.Minute)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					mu.Lock()
+					added++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if added != 1 {
+			t.Fatalf("%d concurrent Adds succeeded, want 1", added)
+		}
+	})
+}
+
+func TestStoreList(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		for _, key := range []string{"bans/ip/1", "bans/user/alice", "records/a*b", "other"} {
+			if err := store.Put(key, []byte("x"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys, err := store.List("bans/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if fmt.Sprint(keys) != "[bans/ip/1 bans/user/alice]" {
+			t.Fatalf("List: got %v", keys)
+		}
+
+		// Glob characters in keys are no patterns
+		if keys, err := store.List("records/a*"); err != nil || len(keys) != 1 {
+			t.Fatalf("List with a glob character: got %v, %v", keys, err)
+		}
+		if keys, err := store.List("records/a?"); err != nil || len(keys) != 0 {
+			t.Fatalf("List with a glob character: got %v, %v", keys, err)
+		}
+	})
+}
+
+func TestStoreIncr(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			store := newStore()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if _, err := store.Incr("quota/x", time.Minute); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		n, err := newStore().Incr("quota/x", time.Minute)
+		if err != nil || n != 51 {
+			t.Fatalf("Incr: got %d, %v, want 51", n, err)
+		}
+		if value, _ := newStore().Get("quota/x"); string(value) != "51" {
+			t.Fatalf("Get of a counter: got %q, want %q", value, "51")
+		}
+	})
+}
+
+func TestStoreExpiry(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ttl := 500 * time.Millisecond
+
+		if err := store.Put("put", []byte("x"), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Add("add", []byte("x"), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Incr("incr", ttl); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put("forever", []byte("x"), 0); err != nil {
+			t.Fatal(err)
+		}
+		// The ttl is only set when the counter is created
+		time.Sleep(ttl / 2)
+		if _, err := store.Incr("incr", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(ttl)
+		for _, key := range []string{"put", "add", "incr"} {
+			if _, err := store.Get(key); err != ErrNotFound {
+				t.Errorf("Get of expired %s: got %v, want %v", key, err, ErrNotFound)
+			}
+		}
+		if _, err := store.Get("forever"); err != nil {
+			t.Errorf("Get of a key without ttl: %v", err)
+		}
+		if keys, _ := store.List(""); len(keys) != 1 {
+			t.Errorf("List lists expired keys: %v", keys)
+		}
+		if ok, err := store.Add("add", []byte("y"), 0); err != nil || !ok {
+			t.Errorf("Add of an expired key: got %v, %v, want true", ok, err)
+		}
+		if n, err := store.Incr("incr", 0); err != nil || n != 1 {
+			t.Errorf("Incr of an expired counter: got %d, %v, want 1", n, err)
+		}
+	})
+}
+
+func TestStoreLock(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		holders, maxHolders := 0, 0
+		for i := 0; i < 4; i++ {
+			store := newStore()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 3; j++ {
+					unlock, err := store.Lock("zone/example.com")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					holders++
+					if holders > maxHolders {
+						maxHolders = holders
+					}
+					mu.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mu.Lock()
+					holders--
+					mu.Unlock()
+					unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if maxHolders != 1 {
+			t.Fatalf("lock held by %d at the same time", maxHolders)
+		}
+	})
+}
+
+func TestStoreLockNames(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		a, b := newStore(), newStore()
+
+		unlock, err := a.Lock("zone/example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unlock()
+
+		// Other locks are independent
+		done := make(chan struct{})
+		go func() {
+			unlock, err := b.Lock("zone/example.org")
+			if err == nil {
+				unlock()
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("lock on another name blocked")
+		}
+	})
+}
+
+func TestClaimJob(t *testing.T) {
+	testStores(t, func(t *testing.T, newStore func() Store) {
+		interval := time.Hour
+		now := time.Now().Truncate(interval)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		claimed := 0
+		for i := 0; i < 5; i++ {
+			store := newStore()
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// Instances tick at different times in the same interval
+				ok, err := ClaimJob(store, "expire-records", interval, now.Add(time.Duration(i)*time.Minute))
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					mu.Lock()
+					claimed++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		if claimed != 1 {
+			t.Fatalf("run claimed %d times, want once", claimed)
+		}
+
+		if ok, err := ClaimJob(newStore(), "expire-records", interval, now.Add(interval)); err != nil || !ok {
+			t.Fatalf("claim of the next run: got %v, %v, want true", ok, err)
+		}
+		if ok, err := ClaimJob(newStore(), "other", interval, now); err != nil || !ok {
+			t.Fatalf("claim of another job: got %v, %v, want true", ok, err)
+		}
+	})
+}